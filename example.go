@@ -49,12 +49,12 @@ func main() {
 		os.Exit(1);
 	}
 
-	conn, err := mysql.Open(fmt.Sprintf("mysql://%s:%s@%s:%d/%s",
-		user,
-		pass,
-		host,
-		port,
-		dbname));
+	conn, err := mysql.OpenConfig(&mysql.Config{
+		User: user,
+		Password: pass,
+		Addr: fmt.Sprintf("%s:%d", host, port),
+		Database: dbname,
+	});
 
 	if err != nil {
 		fmt.Printf("Error connecting to %s:%d: %s\n",
@@ -109,12 +109,13 @@ func main() {
 	}
 
 	for res := range rs.Iter() {
-		row := res.Data();
+		var i int;
+		var s string;
 
-		if v, ok := row[0].(int); ok {
-			fmt.Printf("%d %v\n", v, row[1])
+		if e := res.(mysql.Result).Scan(&i, &s); e == nil {
+			fmt.Printf("%d %s\n", i, s)
 		} else {
-			fmt.Printf("Error converting %T to int\n", v)
+			fmt.Printf("Error: %s\n", e)
 		}
 	}
 	stmt.Close();
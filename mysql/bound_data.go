@@ -6,7 +6,8 @@
 package mysql
 
 import (
-	"unsafe";
+	"io";
+	"math";
 )
 
 type BoundData struct {
@@ -15,6 +16,13 @@ type BoundData struct {
 	is_null	[1]byte;
 	error	[1]byte;
 	myType	MysqlType;
+	loc	*Location;	// for temporal results, nil meaning UTC
+
+	// Integers are unsigned: set from the UNSIGNED flag for results.
+	is_unsigned	bool;
+
+	// For parameters sent with COM_STMT_SEND_LONG_DATA.
+	long	io.Reader;
 }
 
 func NewBoundData(t MysqlType, buf []byte, n int) (data *BoundData) {
@@ -31,54 +39,31 @@ func NewBoundData(t MysqlType, buf []byte, n int) (data *BoundData) {
 	return;
 }
 
+// Returns the size of the buffer needed for a value of type t: the fixed
+// binary protocol size for numeric types and n for everything else.
 func correctSize(t MysqlType, n int) (sz int) {
-	switch t {
-	case MysqlTypeNewdecimal:
-		fallthrough
-	case MysqlTypeDecimal:
-		sz = unsafe.Sizeof(float64(0))	// TODO test this case...
-
-	case MysqlTypeTiny:
-		sz = unsafe.Sizeof(int8(0))
-
-	case MysqlTypeShort:
-		sz = unsafe.Sizeof(int16(0))
-
-	case MysqlTypeInt24:
-		fallthrough
-	case MysqlTypeLong:
-		sz = unsafe.Sizeof(int(0))
-
-	case MysqlTypeLonglong:
-		sz = unsafe.Sizeof(int64(0))
-
-	case MysqlTypeFloat:
-		sz = unsafe.Sizeof(float(0))
-
-	case MysqlTypeDouble:
-		sz = unsafe.Sizeof(float64(0))
-
-	// TODO
-	case MysqlTypeDate:
-		fallthrough
-	case MysqlTypeTime:
-		fallthrough
-	case MysqlTypeDatetime:
-		fallthrough
-	case MysqlTypeYear:
-		fallthrough
-	case MysqlTypeNewdate:
-		fallthrough
-	default:
+	if sz = binaryLength(t); sz <= 0 {
 		sz = n
 	}
 	return;
 }
 
-func bytesForUnsafePointer(buf unsafe.Pointer, n int) (b []byte) {
-	b = make([]byte, n);
-	for i := range (b) {
-		b[i] = *((*byte)(unsafe.Pointer(uintptr(buf) + uintptr(i))))
+// Conversions from the little-endian binary protocol representation.
+func convertTiny(b []byte) int8		{ return int8(b[0]) }
+func convertShort(b []byte) int16	{ return int16(getUint16(b)) }
+func convertLong(b []byte) int		{ return int(int32(getUint32(b))) }
+func convertLonglong(b []byte) int64	{ return int64(getUint64(b)) }
+func convertFloat(b []byte) float32 {
+	return math.Float32frombits(getUint32(b))
+}
+func convertDouble(b []byte) float64 {
+	return math.Float64frombits(getUint64(b))
+}
+
+func copyBytes(b []byte) (c []byte) {
+	c = make([]byte, len(b));
+	for i := range c {
+		c[i] = b[i]
 	}
 	return;
 }
@@ -88,7 +73,7 @@ func (d *BoundData) Value() (v interface{}, ok bool) {
 		return nil, true
 	}
 
-	ptr := unsafe.Pointer(&d.buffer[0]);
+	buf := d.buffer[0:d.blen];
 	ok = false;
 
 	switch d.myType {
@@ -98,41 +83,78 @@ func (d *BoundData) Value() (v interface{}, ok bool) {
 	case MysqlTypeVarchar:
 		fallthrough
 	case MysqlTypeString:
-		v, ok = platformConvertString(ptr, d.blen), true
+		v, ok = string(buf), true
 
 	case MysqlTypeTiny:
 		if d.blen == 1 {
-			v, ok = platformConvertTiny(ptr), true
+			if d.is_unsigned {
+				v, ok = uint8(buf[0]), true
+			} else {
+				v, ok = convertTiny(buf), true
+			}
 		}
 
 	case MysqlTypeShort:
 		if d.blen == 2 {
-			v, ok = platformConvertShort(ptr), true
+			if d.is_unsigned {
+				v, ok = getUint16(buf), true
+			} else {
+				v, ok = convertShort(buf), true
+			}
 		}
 
+	case MysqlTypeInt24:
+		fallthrough
 	case MysqlTypeLong:
 		if d.blen == 4 {
-			v, ok = platformConvertLong(ptr), true
+			if d.is_unsigned {
+				v, ok = getUint32(buf), true
+			} else {
+				v, ok = convertLong(buf), true
+			}
 		}
 
 	case MysqlTypeLonglong:
 		if d.blen == 8 {
-			v, ok = platformConvertLonglong(ptr), true
+			if d.is_unsigned {
+				v, ok = getUint64(buf), true
+			} else {
+				v, ok = convertLonglong(buf), true
+			}
 		}
 
 	case MysqlTypeFloat:
 		if d.blen == 4 {
-			v, ok = platformConvertFloat(ptr), true
+			v, ok = convertFloat(buf), true
 		}
 
 	case MysqlTypeNewdecimal:
 		fallthrough
 	case MysqlTypeDecimal:
-		fallthrough
+		// Sent as text by the server, and kept that way so that
+		// nothing is lost.
+		v, ok = Decimal(string(buf)), true
+
 	case MysqlTypeDouble:
 		if d.blen == 8 {
-			v, ok = platformConvertDouble(ptr), true
+			v, ok = convertDouble(buf), true
+		}
+
+	case MysqlTypeTimestamp:
+		fallthrough
+	case MysqlTypeDate:
+		fallthrough
+	case MysqlTypeNewdate:
+		fallthrough
+	case MysqlTypeDatetime:
+		loc := d.loc;
+		if loc == nil {
+			loc = UTC
 		}
+		v, ok = decodeDate(buf, loc);
+
+	case MysqlTypeTime:
+		v, ok = decodeTime(buf)
 
 	case MysqlTypeTinyBlob:
 		fallthrough
@@ -145,20 +167,8 @@ func (d *BoundData) Value() (v interface{}, ok bool) {
 
 	case MysqlTypeNull:
 		fallthrough
-	case MysqlTypeTimestamp:
-		fallthrough
-	case MysqlTypeInt24:
-		fallthrough
-	case MysqlTypeDate:
-		fallthrough
-	case MysqlTypeTime:
-		fallthrough
-	case MysqlTypeDatetime:
-		fallthrough
 	case MysqlTypeYear:
 		fallthrough
-	case MysqlTypeNewdate:
-		fallthrough
 	case MysqlTypeBit:
 		fallthrough
 	case MysqlTypeEnum:
@@ -166,7 +176,7 @@ func (d *BoundData) Value() (v interface{}, ok bool) {
 	case MysqlTypeSet:
 		fallthrough
 	case MysqlTypeGeometry:
-		v = bytesForUnsafePointer(ptr, d.blen);
+		v = copyBytes(buf);
 		ok = true;
 	}
 
@@ -0,0 +1,121 @@
+// Copyright 2009 Eden Li. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// A per-connection cache of prepared statements, so that running the same
+// query again skips the COM_STMT_PREPARE round trip.
+package mysql
+
+import (
+	"db";
+	"os";
+	"container/list";
+)
+
+const defaultStatementCacheSize = 16
+
+// The statements Query and ExecQuery prepared, most recently used first.
+type stmtCache struct {
+	size	int;
+	lru	*list.List;
+}
+
+type cachedStmt struct {
+	stmt	*mysqlStmt;
+	busy	int;	// executions under way, which keep it from being closed
+}
+
+func newStmtCache(size int) *stmtCache	{ return &stmtCache{size, list.New()} }
+
+// Returns the statement for query, preparing it unless it is cached.  The
+// caller holds the connection lock, and releases the statement once it has
+// been executed.
+func (c *stmtCache) get(h *mysqlConn, query string) (cs *cachedStmt, err os.Error) {
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		if cs = e.Value.(*cachedStmt); cs.stmt.query == query {
+			c.lru.MoveToFront(e);
+			cs.busy++;
+			return;
+		}
+	}
+	s, err := h.prepareRevived(query);
+	if err != nil {
+		return nil, err
+	}
+	cs = &cachedStmt{stmt: s, busy: 1};
+	c.lru.PushFront(cs);
+	return;
+}
+
+func (c *stmtCache) release(cs *cachedStmt) {
+	cs.busy--;
+	c.evict();
+}
+
+// Closes the least recently used statements beyond the size of the cache,
+// other than those being executed.
+func (c *stmtCache) evict() {
+	for e := c.lru.Back(); e != nil && c.lru.Len() > c.size; {
+		prev := e.Prev();
+		if cs := e.Value.(*cachedStmt); cs.busy == 0 {
+			c.lru.Remove(e);
+			cs.stmt.close();
+		}
+		e = prev;
+	}
+}
+
+// Sets how many statements Query and ExecQuery keep prepared, 16 by
+// default.  Statements beyond the new size are closed; 0 turns the cache
+// off.
+func (conn Connection) SetStatementCacheSize(n int) {
+	conn.owner.Lock();
+	conn.Lock();
+	c := conn.handle.cache;
+	c.size = n;
+	c.evict();
+	conn.Unlock();
+	conn.owner.Unlock();
+}
+
+// Prepares and executes query in one go, as Prepare and Execute would but
+// with the statement kept prepared for the next time.
+func (conn Connection) Query(query string, parameters ...) (rs db.ResultSet, err os.Error) {
+	conn.owner.Lock();
+	cur, err := conn.executeCached(query, parameters);
+	if err == nil {
+		rs = ResultSet{conn: conn, cursor: cur}
+	}
+	conn.owner.Unlock();
+	return;
+}
+
+// Prepares and executes query in one go, as Prepare and Exec would but with
+// the statement kept prepared for the next time.
+func (conn Connection) ExecQuery(query string, parameters ...) (affectedRows, insertId uint64, err os.Error) {
+	conn.owner.Lock();
+	cur, err := conn.executeCached(query, parameters);
+	if err == nil {
+		affectedRows, insertId = cur.affectedRows, cur.insertId;
+		cur.Close();
+	}
+	conn.owner.Unlock();
+	return;
+}
+
+func (conn Connection) executeCached(query string, parameters ...) (cur *cursor, err os.Error) {
+	conn.Lock();
+	cache := conn.handle.cache;
+	cs, err := cache.get(conn.handle, query);
+	conn.Unlock();
+	if err != nil {
+		return
+	}
+
+	cur, err = conn.execute(Statement{stmt: cs.stmt, conn: &conn}, true, nil, parameters);
+
+	conn.Lock();
+	cache.release(cs);
+	conn.Unlock();
+	return;
+}
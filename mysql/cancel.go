@@ -0,0 +1,119 @@
+// Copyright 2009 Eden Li. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Cancellation and timeouts.
+package mysql
+
+import (
+	"db";
+	"os";
+	"sync";
+	"time";
+)
+
+// Returned in place of the server's error when a statement was interrupted
+// by ExecuteCancel or ExecCancel.
+var (
+	ErrCanceled	= MysqlError("Statement was canceled");
+	ErrTimeout	= MysqlError("Statement timed out");
+)
+
+// Executes like Execute, but interrupts the statement if cancel receives a
+// value or is closed, or if it runs for longer than timeout nanoseconds.
+// Either may be left out by passing nil or 0.  The timeout only starts
+// once the connection is free to run the statement.  An interrupted
+// statement fails with ErrCanceled or ErrTimeout, and the connection can be
+// used again straight away.
+//
+// The statement is interrupted with KILL QUERY sent from a second
+// connection, which is opened with the same user and password.
+func (conn Connection) ExecuteCancel(cancel <-chan bool, timeout int64, stmt db.Statement, parameters ...) (rs db.ResultSet, err os.Error) {
+	s := stmt.(Statement);
+	conn.owner.Lock();
+	rs, err = newResultSet(conn, s, true, newWatcher(conn, cancel, timeout), parameters);
+	conn.owner.Unlock();
+	return;
+}
+
+// Exec with cancellation and a timeout, as ExecuteCancel.
+func (conn Connection) ExecCancel(cancel <-chan bool, timeout int64, stmt db.Statement, parameters ...) (affectedRows, insertId uint64, err os.Error) {
+	conn.owner.Lock();
+	affectedRows, insertId, err = conn.exec(stmt, newWatcher(conn, cancel, timeout), parameters);
+	conn.owner.Unlock();
+	return;
+}
+
+// Kills the statement running on a connection if it's cancelled or times
+// out before done is called.  It's started by execute once it holds the
+// connection, so that nothing but its own statement can be killed.
+type watcher struct {
+	conn		Connection;
+	lock		*sync.Mutex;
+	cancel		<-chan bool;
+	timeout		int64;
+	expired		chan bool;
+	stop		chan bool;
+	finished	bool;
+	cause		os.Error;	// why the statement was killed
+}
+
+func newWatcher(conn Connection, cancel <-chan bool, timeout int64) *watcher {
+	w := &watcher{conn: conn, lock: new(sync.Mutex), cancel: cancel, timeout: timeout};
+	w.stop = make(chan bool, 1);
+	return w;
+}
+
+// Starts watching, unless the statement was cancelled while waiting for the
+// connection, which it reports instead.
+func (w *watcher) start() (err os.Error) {
+	select {
+	case <-w.cancel:
+		return ErrCanceled
+	default:
+	}
+	if w.timeout > 0 {
+		w.expired = make(chan bool, 1);
+		go func() {
+			time.Sleep(w.timeout);
+			w.expired <- true;
+		}();
+	}
+	go w.run();
+	return;
+}
+
+func (w *watcher) run() {
+	var cause os.Error;
+	select {
+	case <-w.stop:
+		return
+	case <-w.cancel:
+		cause = ErrCanceled
+	case <-w.expired:
+		cause = ErrTimeout
+	}
+
+	// Holding the lock keeps done from returning, and so the connection
+	// from starting another statement, until the kill has been sent.
+	w.lock.Lock();
+	if !w.finished && w.conn.handle.kill() == nil {
+		w.cause = cause
+	}
+	w.lock.Unlock();
+}
+
+// Stops watching.  err is the statement's error, which is replaced by
+// ErrCanceled or ErrTimeout if the statement was killed.
+func (w *watcher) done(err os.Error) os.Error {
+	w.lock.Lock();
+	w.finished = true;
+	cause := w.cause;
+	w.lock.Unlock();
+	w.stop <- true;
+
+	if err != nil && cause != nil {
+		return cause
+	}
+	return err;
+}
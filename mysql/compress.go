@@ -0,0 +1,117 @@
+// Copyright 2009 Eden Li. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The compressed protocol, used once the handshake has agreed on
+// CLIENT_COMPRESS.  Every write to the connection goes out as a packet with
+// a header of its own: the 3-byte length, a sequence number and the 3-byte
+// length of the payload once inflated, 0 when it was sent as is.
+package mysql
+
+import (
+	"io";
+	"os";
+	"fmt";
+	"bytes";
+	"bufio";
+	"compress/zlib";
+)
+
+// Payloads shorter than this aren't worth compressing.
+const minCompressLength = 50
+
+// Inflates the packets read from the connection.
+type compressedReader struct {
+	h	*mysqlConn;
+	rd	io.Reader;	// the connection itself
+	buf	*bytes.Buffer;	// what is left of the last packet
+}
+
+// Switches the connection over to the compressed protocol.
+func (h *mysqlConn) startCompression() {
+	h.rd = bufio.NewReader(&compressedReader{h, h.rd, new(bytes.Buffer)});
+	h.compressed = true;
+}
+
+func (c *compressedReader) Read(p []byte) (n int, err os.Error) {
+	if c.buf.Len() == 0 {
+		if err = c.fill(); err != nil {
+			return
+		}
+	}
+	return c.buf.Read(p);
+}
+
+func (c *compressedReader) fill() (err os.Error) {
+	header := make([]byte, 7);
+	if _, err = io.ReadFull(c.rd, header); err != nil {
+		return
+	}
+	if header[3] != c.h.cseq {
+		return MysqlError(fmt.Sprintf("Compressed packets out of order (got %d, expected %d)",
+			header[3], c.h.cseq))
+	}
+	c.h.cseq++;
+
+	body := make([]byte, getUint24(header[0:3]));
+	if _, err = io.ReadFull(c.rd, body); err != nil {
+		return
+	}
+	n := int(getUint24(header[4:7]));
+	if n == 0 {
+		c.buf.Write(body);
+		return;
+	}
+	z, err := zlib.NewInflater(bytes.NewBuffer(body));
+	if err != nil {
+		return
+	}
+	data := make([]byte, n);
+	_, err = io.ReadFull(z, data);
+	z.Close();
+	if err == nil {
+		c.buf.Write(data)
+	}
+	return;
+}
+
+// Writes p to the connection, compressed if the protocol calls for it.
+func (h *mysqlConn) write(p []byte) (err os.Error) {
+	if !h.compressed {
+		_, err = h.nc.Write(p);
+		return;
+	}
+	for len(p) > 0 {
+		n := len(p);
+		if n > maxPacketSize {
+			n = maxPacketSize
+		}
+		body, size := p[0:n], 0;
+		if n >= minCompressLength {
+			var z bytes.Buffer;
+			w, e := zlib.NewDeflater(&z);
+			if e != nil {
+				return e
+			}
+			w.Write(body);
+			if e = w.Close(); e != nil {
+				return e
+			}
+			if z.Len() < n {
+				body, size = z.Bytes(), n
+			}
+		}
+
+		var b bytes.Buffer;
+		putUint24(&b, uint32(len(body)));
+		b.WriteByte(h.cseq);
+		putUint24(&b, uint32(size));
+		b.Write(body);
+		h.cseq++;
+		if _, err = h.nc.Write(b.Bytes()); err != nil {
+			return
+		}
+		p = p[n:len(p)];
+	}
+	return;
+}
@@ -0,0 +1,348 @@
+// Copyright 2009 Eden Li. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Connection settings as a struct rather than a URL.
+package mysql
+
+import (
+	"db";
+	"os";
+	"fmt";
+	"http";
+	"sync";
+	"bytes";
+	"strings";
+	"strconv";
+)
+
+// Everything needed to open a connection.  The options are the ones the URL
+// passed to Open takes, and are described there.
+type Config struct {
+	User		string;
+	Password	string;
+	Net		string;	// "tcp" (the default) or "unix"
+	Addr		string;	// host:port, or the path of the unix socket
+	Database	string;
+
+	// Timeouts in nanoseconds, 0 for none.
+	ConnectTimeout	int64;
+	ReadTimeout	int64;
+	WriteTimeout	int64;
+
+	Charset		string;
+	Compress	bool;
+	LocalInfile	bool;
+	MultiStatements	bool;
+	FoundRows	bool;
+	InitCommands	[]string;
+	Reconnect	bool;
+
+	SSLMode		string;
+	SSLCA		string;
+	SSLCert		string;
+	SSLKey		string;
+	SSLCipher	string;
+	SSLServerName	string;
+}
+
+// Parses a URL of the form Open takes.  The user name, password, database
+// and option values are unescaped, so that they may hold any character.
+func ParseURL(uri string) (c *Config, err os.Error) {
+	url, urlError := http.ParseURL(uri);
+	if urlError != nil {
+		return nil, MysqlError(fmt.Sprintf("Couldn't parse URL: %s", urlError))
+	}
+	if len(url.Scheme) > 0 && url.Scheme != "mysql" {
+		return nil, MysqlError(fmt.Sprintf("Invalid scheme: %s", url.Scheme))
+	}
+
+	c = &Config{Net: "tcp", Addr: defaultHost + ":" + defaultPort};
+	socket := "";
+	for _, kv := range strings.Split(url.RawQuery, "&", 0) {
+		if len(kv) == 0 {
+			continue
+		}
+		pair := strings.Split(kv, "=", 2);
+		key, e := http.URLUnescape(pair[0]);
+		value := "";
+		if e == nil && len(pair) == 2 {
+			value, e = http.URLUnescape(pair[1])
+		}
+		if e != nil {
+			return nil, MysqlError(fmt.Sprintf("Invalid option: %s", kv))
+		}
+		if key == "socket" {
+			socket = value
+		} else if err = c.set(key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if url.Host == "socket." {
+		if len(socket) == 0 {
+			return nil, MysqlError(
+				fmt.Sprintf("Invalid socket specified: %s", url.RawQuery))
+		}
+		c.Net, c.Addr = "unix", socket;
+	} else if len(url.Host) > 0 {
+		host, port := defaultHost, defaultPort;
+		hostport := strings.Split(url.Host, ":", 2);
+		if len(hostport) == 2 && len(hostport[1]) > 0 {
+			if _, e := strconv.Atoi(hostport[1]); e != nil {
+				return nil, MysqlError(
+					fmt.Sprintf("Invalid port specified: %s", hostport[1]))
+			}
+			port = hostport[1];
+		}
+		if len(hostport[0]) > 0 {
+			host = hostport[0]
+		}
+		c.Addr = host + ":" + port;
+	}
+
+	if len(url.Userinfo) > 0 {
+		userpass := strings.Split(url.Userinfo, ":", 2);
+		if c.User, err = http.URLUnescape(userpass[0]); err == nil && len(userpass) == 2 {
+			c.Password, err = http.URLUnescape(userpass[1])
+		}
+		if err != nil {
+			return nil, MysqlError(fmt.Sprintf("Invalid user: %s", url.Userinfo))
+		}
+	}
+
+	if len(url.Path) > 0 {
+		path := strings.Split(url.Path, "/", 2);
+		if len(path) == 2 && len(path[0]) == 0 {
+			c.Database = path[1]
+		}
+	}
+	return;
+}
+
+// Sets the option named key in a URL from its text.
+func (c *Config) set(key, value string) os.Error {
+	ok := true;
+	switch key {
+	case "connect_timeout":
+		c.ConnectTimeout, ok = parseSeconds(value)
+	case "read_timeout":
+		c.ReadTimeout, ok = parseSeconds(value)
+	case "write_timeout":
+		c.WriteTimeout, ok = parseSeconds(value)
+	case "charset":
+		c.Charset = value;
+		_, ok = charsets[strings.ToLower(value)];
+	case "compress":
+		c.Compress, ok = parseBool(value)
+	case "local_infile":
+		c.LocalInfile, ok = parseBool(value)
+	case "multi_statements":
+		c.MultiStatements, ok = parseBool(value)
+	case "found_rows":
+		c.FoundRows, ok = parseBool(value)
+	case "reconnect":
+		c.Reconnect, ok = parseBool(value)
+	case "ssl_mode":
+		c.SSLMode = value;
+		_, ok = sslModes[strings.ToLower(value)];
+	case "ssl_ca":
+		c.SSLCA, ok = value, len(value) > 0
+	case "ssl_cert":
+		c.SSLCert, ok = value, len(value) > 0
+	case "ssl_key":
+		c.SSLKey, ok = value, len(value) > 0
+	case "ssl_cipher":
+		c.SSLCipher = value;
+		_, ok = parseCiphers(value);
+	case "ssl_server_name":
+		c.SSLServerName, ok = value, len(value) > 0
+	case "init_command":
+		if ok = len(value) > 0; ok {
+			cmds := make([]string, len(c.InitCommands)+1);
+			for i, cmd := range c.InitCommands {
+				cmds[i] = cmd
+			}
+			cmds[len(cmds)-1] = value;
+			c.InitCommands = cmds;
+		}
+	default:
+		return MysqlError(fmt.Sprintf("Unknown option: %s", key))
+	}
+	if !ok {
+		return MysqlError(fmt.Sprintf("Invalid value for option %s: %s", key, value))
+	}
+	return nil;
+}
+
+// Returns the URL for c, which ParseURL turns back into the same Config.
+// Options left at their defaults are left out.
+func (c *Config) FormatURL() string {
+	var b bytes.Buffer;
+	b.WriteString("mysql://");
+	if len(c.User) > 0 || len(c.Password) > 0 {
+		b.WriteString(escape(c.User));
+		if len(c.Password) > 0 {
+			b.WriteByte(':');
+			b.WriteString(escape(c.Password));
+		}
+		b.WriteByte('@');
+	}
+	var q queryWriter;
+	if c.Net == "unix" {
+		b.WriteString("socket.");
+		q.add("socket", c.Addr);
+	} else {
+		b.WriteString(c.Addr)
+	}
+	b.WriteByte('/');
+	b.WriteString(escape(c.Database));
+
+	q.addSeconds("connect_timeout", c.ConnectTimeout);
+	q.addSeconds("read_timeout", c.ReadTimeout);
+	q.addSeconds("write_timeout", c.WriteTimeout);
+	q.add("charset", c.Charset);
+	q.addBool("compress", c.Compress);
+	q.addBool("local_infile", c.LocalInfile);
+	q.addBool("multi_statements", c.MultiStatements);
+	q.addBool("found_rows", c.FoundRows);
+	q.addBool("reconnect", c.Reconnect);
+	q.add("ssl_mode", c.SSLMode);
+	q.add("ssl_ca", c.SSLCA);
+	q.add("ssl_cert", c.SSLCert);
+	q.add("ssl_key", c.SSLKey);
+	q.add("ssl_cipher", c.SSLCipher);
+	q.add("ssl_server_name", c.SSLServerName);
+	for _, cmd := range c.InitCommands {
+		q.add("init_command", cmd)
+	}
+	if q.Len() > 0 {
+		b.WriteByte('?');
+		b.Write(q.Bytes());
+	}
+	return b.String();
+}
+
+// Escapes s for any part of a URL.  Unlike http.URLEscape, it writes spaces
+// as %20, since a '+' only stands for a space in the query.
+func escape(s string) string {
+	var b bytes.Buffer;
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%');
+			b.WriteByte("0123456789ABCDEF"[c>>4]);
+			b.WriteByte("0123456789ABCDEF"[c&15]);
+		}
+	}
+	return b.String();
+}
+
+// Builds the query of a URL, skipping empty values.
+type queryWriter struct {
+	bytes.Buffer;
+}
+
+func (q *queryWriter) add(key, value string) {
+	if len(value) == 0 {
+		return
+	}
+	if q.Len() > 0 {
+		q.WriteByte('&')
+	}
+	q.WriteString(key);
+	q.WriteByte('=');
+	q.WriteString(escape(value));
+}
+
+func (q *queryWriter) addBool(key string, value bool) {
+	if value {
+		q.add(key, "true")
+	}
+}
+
+func (q *queryWriter) addSeconds(key string, ns int64) {
+	if ns > 0 {
+		q.add(key, strconv.Ftoa64(float64(ns)/1e9, 'g', -1))
+	}
+}
+
+// Checks the options of a Config built without ParseURL, the values of
+// which set hasn't seen.
+func (c *Config) check() os.Error {
+	text := map[string]string{
+		"charset": c.Charset,
+		"ssl_mode": c.SSLMode,
+		"ssl_cipher": c.SSLCipher,
+	};
+	var scratch Config;
+	for key, value := range text {
+		if len(value) == 0 {
+			continue
+		}
+		if err := scratch.set(key, value); err != nil {
+			return err
+		}
+	}
+	return nil;
+}
+
+// Works out the options for connect, loading the files the TLS options name.
+func (c *Config) options() (o *options, err os.Error) {
+	o = &options{
+		connectTimeout: c.ConnectTimeout,
+		readTimeout: c.ReadTimeout,
+		writeTimeout: c.WriteTimeout,
+		charset: defaultCharset,
+		compress: c.Compress,
+		localInfile: c.LocalInfile,
+		multiStatements: c.MultiStatements,
+		foundRows: c.FoundRows,
+		initCommands: c.InitCommands,
+		reconnect: c.Reconnect,
+		sslCA: c.SSLCA,
+		sslCert: c.SSLCert,
+		sslKey: c.SSLKey,
+		sslServerName: c.SSLServerName,
+	};
+	// set has checked these already, or check has for a Config that
+	// didn't come from ParseURL.
+	if len(c.Charset) > 0 {
+		o.charset = charsets[strings.ToLower(c.Charset)]
+	}
+	o.sslMode = sslModes[strings.ToLower(c.SSLMode)];
+	o.sslCiphers, _ = parseCiphers(c.SSLCipher);
+	if err = o.setupTLS(); err != nil {
+		return nil, err
+	}
+	return;
+}
+
+// Opens a connection as Open does, from a Config instead of a URL.
+func OpenConfig(c *Config) (conn db.Connection, err os.Error) {
+	if err = c.check(); err != nil {
+		return
+	}
+	opts, err := c.options();
+	if err != nil {
+		return
+	}
+	network, addr := c.Net, c.Addr;
+	if len(network) == 0 {
+		network = "tcp"
+	}
+	if len(addr) == 0 && network == "tcp" {
+		addr = defaultHost + ":" + defaultPort
+	}
+
+	h := Connection{};
+	h.lock = new(sync.Mutex);
+	h.owner = new(sync.Mutex);
+	if h.handle, err = connect(network, addr, c.User, c.Password, c.Database, opts); err == nil {
+		conn = h
+	}
+	return;
+}
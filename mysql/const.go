@@ -36,3 +36,120 @@ const (
 	MysqlTypeString		= 254;
 	MysqlTypeGeometry	= 255;
 )
+
+// Server status flags, as reported by ResultSet.Status.
+const (
+	ServerStatusInTrans		= 1 << iota;
+	ServerStatusAutocommit;
+	serverStatusReserved;
+	ServerMoreResultsExists;
+	ServerQueryNoGoodIndexUsed;
+	ServerQueryNoIndexUsed;
+	ServerStatusCursorExists;
+	ServerStatusLastRowSent;
+	ServerStatusDbDropped;
+	ServerStatusNoBackslashEscapes;
+	ServerStatusMetadataChanged;
+	ServerQueryWasSlow;
+	ServerPsOutParams;
+	ServerStatusInTransReadonly;
+)
+
+// Column definition flags.
+const (
+	NotNullFlag	= 1 << iota;
+	PriKeyFlag;
+	UniqueKeyFlag;
+	MultipleKeyFlag;
+	BlobFlag;
+	UnsignedFlag;
+	ZerofillFlag;
+	BinaryFlag;
+	EnumFlag;
+	AutoIncrementFlag;
+	TimestampFlag;
+	SetFlag;
+)
+
+// Client capability flags negotiated during the handshake.
+const (
+	clientLongPassword	= 1 << iota;
+	clientFoundRows;
+	clientLongFlag;
+	clientConnectWithDb;
+	clientNoSchema;
+	clientCompress;
+	clientODBC;
+	clientLocalFiles;
+	clientIgnoreSpace;
+	clientProtocol41;
+	clientInteractive;
+	clientSSL;
+	clientIgnoreSigpipe;
+	clientTransactions;
+	clientReserved;
+	clientSecureConnection;
+	clientMultiStatements;
+	clientMultiResults;
+	clientPsMultiResults;
+	clientPluginAuth;
+)
+
+// Commands, sent as the first byte of every request packet.
+const (
+	comQuit			= 0x01;
+	comInitDb		= 0x02;
+	comQuery		= 0x03;
+	comPing			= 0x0e;
+	comStmtPrepare		= 0x16;
+	comStmtExecute		= 0x17;
+	comStmtSendLongData	= 0x18;
+	comStmtClose		= 0x19;
+	comStmtReset		= 0x1a;
+	comStmtFetch		= 0x1c;
+)
+
+// COM_STMT_EXECUTE flags.
+const (
+	cursorTypeNoCursor	= 0;
+	cursorTypeReadOnly	= 1;
+)
+
+// Error numbers used for errors detected on the client side, matching the
+// CR_* codes of libmysqlclient.
+const (
+	crUnknownError		= 2000;
+	crConnectionError	= 2002;
+	crConnHostError		= 2003;
+	crServerGoneError	= 2006;
+	crServerLost		= 2013;
+	crCommandsOutOfSync	= 2014;
+	crDataTruncated		= 2032;
+	crSSLConnectionError	= 2026;
+	crMalformedPacket	= 2027;
+	crAuthPluginCannotLoad	= 2059;
+)
+
+// Server error numbers we classify (see errors.go).
+const (
+	erDupKey				= 1022;
+	erServerShutdown			= 1053;
+	erDupEntry				= 1062;
+	erDupUnique				= 1169;
+	erLockWaitTimeout			= 1205;
+	erLockDeadlock				= 1213;
+	erOptionPreventsStatement		= 1290;
+	erDupEntryWithKeyName			= 1586;
+	erCantExecuteInReadOnlyTransaction	= 1792;
+)
+
+const (
+	protocolVersion		= 10;
+	maxPacketSize		= 1<<24 - 1;
+	defaultCharset		= 33;	// utf8_general_ci
+	nativePasswordPlugin	= "mysql_native_password";
+
+	// Parameters longer than this are sent in chunks of this size, well
+	// under the 1MB default of max_allowed_packet.
+	longDataChunkSize	= 1 << 19;
+)
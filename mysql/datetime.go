@@ -0,0 +1,141 @@
+// Copyright 2009 Eden Li. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// DATE, DATETIME, TIMESTAMP and TIME values.
+package mysql
+
+import (
+	"fmt";
+	"time";
+	"bytes";
+)
+
+// The time zone DATE, DATETIME and TIMESTAMP values are taken to be in.
+// The server stores them without a zone, so this only decides the zone
+// fields of the time.Time values returned, and the zone time.Time
+// parameters are converted to before being sent.
+type Location struct {
+	Offset	int;	// seconds east of UTC
+	Name	string;
+}
+
+var UTC = &Location{0, "UTC"}
+
+// Returns the current local time zone.
+func LocalLocation() *Location {
+	t := time.LocalTime();
+	return &Location{t.ZoneOffset, t.Zone};
+}
+
+// A TIME value.  Unlike a time of day it may be negative and may exceed 24
+// hours, so it's kept as a number of nanoseconds.
+type Duration int64
+
+// Formats d the way MySQL does: [-]HH:MM:SS[.ffffff].
+func (d Duration) String() string {
+	sign := "";
+	if d < 0 {
+		sign, d = "-", -d
+	}
+	sec := int64(d) / 1e9;
+	s := fmt.Sprintf("%s%02d:%02d:%02d", sign, sec/3600, sec/60%60, sec%60);
+	if micro := int64(d) % 1e9 / 1e3; micro != 0 {
+		s += fmt.Sprintf(".%06d", micro)
+	}
+	return s;
+}
+
+// Decodes a binary protocol DATE, DATETIME or TIMESTAMP.  Trailing fields
+// the server left out are zero; so is everything for 0000-00-00.  The
+// microseconds of MySQL 5.6 are dropped as time.Time doesn't hold them.
+func decodeDate(b []byte, loc *Location) (t *time.Time, ok bool) {
+	if len(b) != 0 && len(b) != 4 && len(b) != 7 && len(b) != 11 {
+		return
+	}
+	t = &time.Time{ZoneOffset: loc.Offset, Zone: loc.Name};
+	if len(b) >= 4 {
+		t.Year = int64(getUint16(b[0:2]));
+		t.Month, t.Day = int(b[2]), int(b[3]);
+	}
+	if len(b) >= 7 {
+		t.Hour, t.Minute, t.Second = int(b[4]), int(b[5]), int(b[6])
+	}
+	if t.Month != 0 && t.Day != 0 {
+		t.Weekday = time.SecondsToUTC(t.Seconds() + int64(loc.Offset)).Weekday
+	}
+	return t, true;
+}
+
+// Decodes a binary protocol TIME.
+func decodeTime(b []byte) (d Duration, ok bool) {
+	if len(b) != 0 && len(b) != 8 && len(b) != 12 {
+		return
+	}
+	if len(b) >= 8 {
+		sec := ((int64(getUint32(b[1:5]))*24+int64(b[5]))*60+
+			int64(b[6]))*60 + int64(b[7]);
+		d = Duration(sec * 1e9);
+		if len(b) == 12 {
+			d += Duration(int64(getUint32(b[8:12])) * 1e3)
+		}
+		if b[0] == 1 {
+			d = -d
+		}
+	}
+	return d, true;
+}
+
+// Encodes t as a DATETIME in the zone loc.
+func encodeDate(t *time.Time, loc *Location) []byte {
+	u := time.SecondsToUTC(t.Seconds() + int64(loc.Offset));
+	var b bytes.Buffer;
+	putUint16(&b, uint16(u.Year));
+	b.WriteByte(byte(u.Month));
+	b.WriteByte(byte(u.Day));
+	b.WriteByte(byte(u.Hour));
+	b.WriteByte(byte(u.Minute));
+	b.WriteByte(byte(u.Second));
+	return b.Bytes();
+}
+
+// Encodes d as a TIME.
+func encodeTime(d Duration) []byte {
+	var b bytes.Buffer;
+	if d < 0 {
+		b.WriteByte(1);
+		d = -d;
+	} else {
+		b.WriteByte(0)
+	}
+	sec := int64(d) / 1e9;
+	putUint32(&b, uint32(sec/86400));
+	b.WriteByte(byte(sec / 3600 % 24));
+	b.WriteByte(byte(sec / 60 % 60));
+	b.WriteByte(byte(sec % 60));
+	if micro := int64(d) % 1e9 / 1e3; micro != 0 {
+		putUint32(&b, uint32(micro))
+	}
+	return b.Bytes();
+}
+
+// Binds the parameter types of this file: time.Time, *time.Time and
+// Duration.
+func bindTemporal(v interface{}, loc *Location) (d *BoundData, ok bool) {
+	var b []byte;
+	var t MysqlType = MysqlTypeDatetime;
+	switch x := v.(type) {
+	case time.Time:
+		b = encodeDate(&x, loc)
+	case *time.Time:
+		if x == nil {
+			return
+		}
+		b = encodeDate(x, loc);
+	case Duration:
+		b, t = encodeTime(x), MysqlTypeTime
+	default:
+		return
+	}
+	return NewBoundData(t, b, len(b)), true;
+}
@@ -0,0 +1,63 @@
+// Copyright 2009 Eden Li. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// DECIMAL and NUMERIC values.
+package mysql
+
+import (
+	"os";
+	"big";
+	"fmt";
+	"strings";
+	"strconv";
+)
+
+// An exact DECIMAL or NUMERIC value, in the text form the server uses, such
+// as "-1234.50".  Bind one as a parameter to send a value exactly.
+type Decimal string
+
+// Makes the Decimal unscaled * 10^-scale.
+func NewDecimal(unscaled *big.Int, scale int) Decimal {
+	s := unscaled.String();
+	sign := "";
+	if s[0] == '-' {
+		sign, s = "-", s[1:len(s)]
+	}
+	if scale <= 0 {
+		return Decimal(sign + s + strings.Repeat("0", -scale))
+	}
+	if len(s) <= scale {
+		s = strings.Repeat("0", scale-len(s)+1) + s
+	}
+	i := len(s) - scale;
+	return Decimal(sign + s[0:i] + "." + s[i:len(s)]);
+}
+
+func (d Decimal) String() string	{ return string(d) }
+
+// Returns d as unscaled * 10^-scale, exactly.
+func (d Decimal) Int() (unscaled *big.Int, scale int, err os.Error) {
+	s := string(d);
+	if i := strings.Index(s, "."); i >= 0 {
+		scale = len(s) - i - 1;
+		s = s[0:i] + s[i+1:len(s)];
+	}
+	unscaled, ok := new(big.Int).SetString(s, 10);
+	if !ok {
+		unscaled, scale = nil, 0;
+		err = MysqlError(fmt.Sprintf("Invalid decimal: %s", string(d)));
+	}
+	return;
+}
+
+// Returns the float64 nearest to d.
+func (d Decimal) Float64() (float64, os.Error)	{ return strconv.Atof64(string(d)) }
+
+func bindDecimal(v interface{}) (d *BoundData, ok bool) {
+	if x, isDecimal := v.(Decimal); isDecimal {
+		b := strings.Bytes(string(x));
+		d, ok = NewBoundData(MysqlTypeNewdecimal, b, len(b)), true;
+	}
+	return;
+}
@@ -0,0 +1,72 @@
+// Copyright 2009 Eden Li. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Errors reported by the server or detected while talking to it.
+package mysql
+
+import (
+	"os";
+	"fmt";
+)
+
+// An error with the number and SQLSTATE that mysql_errno and mysql_sqlstate
+// would report.  Server errors use the server's ER_* numbers; problems
+// detected on the client side, such as a dropped connection, use the CR_*
+// numbers of libmysqlclient.
+type Error struct {
+	Number		uint16;
+	SQLState	string;
+	Message		string;
+}
+
+func (e *Error) String() string {
+	return fmt.Sprintf("Error %d (%s): %s", e.Number, e.SQLState, e.Message)
+}
+
+func errorNumber(err os.Error) uint16 {
+	if e, ok := err.(*Error); ok {
+		return e.Number
+	}
+	return 0;
+}
+
+// Reports whether err is a duplicate key error on insert or update.
+func IsDuplicateKey(err os.Error) bool {
+	switch errorNumber(err) {
+	case erDupKey, erDupEntry, erDupUnique, erDupEntryWithKeyName:
+		return true
+	}
+	return false;
+}
+
+// Reports whether err means the transaction was rolled back because of a
+// deadlock, in which case it may be retried.
+func IsDeadlock(err os.Error) bool	{ return errorNumber(err) == erLockDeadlock }
+
+// Reports whether err is a timeout waiting for a row lock.  Only the
+// statement, not the transaction, is rolled back.
+func IsLockWaitTimeout(err os.Error) bool {
+	return errorNumber(err) == erLockWaitTimeout
+}
+
+// Reports whether err means the connection to the server is gone and the
+// Connection must be reopened, unless it was opened with the reconnect
+// option.
+func IsLostConnection(err os.Error) bool {
+	switch errorNumber(err) {
+	case crServerGoneError, crServerLost, erServerShutdown:
+		return true
+	}
+	return false;
+}
+
+// Reports whether err was caused by writing to a server or transaction that
+// is read-only.
+func IsReadOnly(err os.Error) bool {
+	switch errorNumber(err) {
+	case erOptionPreventsStatement, erCantExecuteInReadOnlyTransaction:
+		return true
+	}
+	return false;
+}
@@ -0,0 +1,1117 @@
+// Copyright 2009 Eden Li. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// An in-process MySQL server for tests.  It speaks enough of the client/server
+// protocol for the mysql package to connect, prepare and execute statements,
+// and answers every query from a script of handlers instead of a database.
+//
+//   srv, _ := mysqltest.NewServer();
+//   srv.HandleResult("SELECT 1", &mysqltest.Result{
+//   	Columns: []mysqltest.Column{mysqltest.Column{Name: "1", Type: mysql.MysqlTypeLong}},
+//   	Rows: [][]interface{}{[]interface{}{1}},
+//   });
+//   conn, _ := mysql.Open(srv.URL("test"));
+//
+package mysqltest
+
+import (
+	"io";
+	"os";
+	"fmt";
+	"net";
+	"math";
+	"sync";
+	"time";
+	"bufio";
+	"bytes";
+	"strings";
+	"strconv";
+	"crypto/tls";
+	"compress/zlib";
+)
+
+const serverVersion = "5.1.0-mysqltest"
+
+const (
+	capabilities = 1 |	// CLIENT_LONG_PASSWORD
+		2 |	// CLIENT_FOUND_ROWS
+		4 |	// CLIENT_LONG_FLAG
+		8 |	// CLIENT_CONNECT_WITH_DB
+		clientCompress |
+		128 |	// CLIENT_LOCAL_FILES
+		512 |	// CLIENT_PROTOCOL_41
+		8192 |	// CLIENT_TRANSACTIONS
+		32768 |	// CLIENT_SECURE_CONNECTION
+		1<<16 |	// CLIENT_MULTI_STATEMENTS
+		1<<17 |	// CLIENT_MULTI_RESULTS
+		1<<18;	// CLIENT_PS_MULTI_RESULTS
+	clientCompress		= 32;
+	clientSSL		= 2048;
+	statusInTrans		= 1;
+	statusAutocommit	= 2;
+	statusMoreResults	= 8;
+	statusCursorExists	= 64;
+	statusLastRowSent	= 128;
+	statusPsOutParams	= 4096;
+	binaryCharset		= 63;
+	utf8Charset		= 33;
+)
+
+// Commands, as in the mysql package.
+const (
+	comQuit			= 0x01;
+	comInitDb		= 0x02;
+	comQuery		= 0x03;
+	comPing			= 0x0e;
+	comStmtPrepare		= 0x16;
+	comStmtExecute		= 0x17;
+	comStmtSendLongData	= 0x18;
+	comStmtClose		= 0x19;
+	comStmtReset		= 0x1a;
+	comStmtFetch		= 0x1c;
+)
+
+// Describes a result set column.  Type is one of the mysql.MysqlType
+// constants.  OrgName defaults to Name.
+type Column struct {
+	Name		string;
+	OrgName		string;
+	Table		string;
+	Type		byte;
+	Flags		uint16;
+	Length		uint32;
+	Decimals	uint8;
+	Charset		uint16;
+}
+
+// The scripted response to a query.  A non-zero Errno makes the server answer
+// with an error.  Otherwise a result set is sent if Columns is set and an OK
+// packet if it isn't.
+type Result struct {
+	Columns	[]Column;
+	Rows	[][]interface{};
+
+	AffectedRows	uint64;
+	InsertId	uint64;
+	Status		uint16;
+	Warnings	uint16;
+
+	Errno		uint16;
+	SQLState	string;
+	Message		string;
+
+	// Nanoseconds to take over the answer.  A KILL QUERY for the
+	// connection cuts the wait short with error 1317.
+	Delay	int64;
+
+	// Asks the client for a local file, as LOAD DATA LOCAL INFILE does.
+	// The OK packet sent once it has arrived counts its bytes as the
+	// affected rows.
+	LocalInfile	string;
+
+	// Another result sent after this one, as for each statement of a
+	// stored procedure.  The results of a CALL end with an OK packet, and
+	// those of its OUT parameters come just before it, with
+	// ServerPsOutParams in their Status.
+	More	*Result;
+}
+
+// Returns a Result answering with an OK packet.
+func OK(affectedRows, insertId uint64) *Result {
+	return &Result{AffectedRows: affectedRows, InsertId: insertId}
+}
+
+// Returns a Result answering with an error.
+func Error(errno uint16, sqlstate, msg string) *Result {
+	return &Result{Errno: errno, SQLState: sqlstate, Message: msg}
+}
+
+// Computes the response to a query.  args holds the parameters of a prepared
+// statement and is nil for text queries.  Integers are passed as int64 (uint64
+// when sent unsigned), floating point numbers as float64, strings as string,
+// blobs as []byte, temporal values in their raw binary encoding and NULL as
+// nil.
+type Handler func(query string, args []interface{}) *Result
+
+// A fake server listening on a local TCP port.
+type Server struct {
+	listener	net.Listener;
+	addr		string;
+	lock		*sync.Mutex;
+	handlers	map[string]Handler;
+	threadId	uint32;
+	sessions	map[uint32]*session;
+	prepared	int;
+	closed		int;
+
+	// From the last handshake.
+	flags	uint32;
+	charset	byte;
+
+	tls	*tls.Config;	// set by StartTLS
+}
+
+// Starts a server on an unused port of 127.0.0.1.
+func NewServer() (s *Server, err os.Error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0");
+	if err != nil {
+		return
+	}
+	s = &Server{
+		listener: l,
+		addr: fmt.Sprint(l.Addr()),
+		lock: new(sync.Mutex),
+		handlers: make(map[string]Handler),
+		sessions: make(map[uint32]*session),
+	};
+	go s.serve();
+	return;
+}
+
+// The host:port the server is listening on.
+func (s *Server) Addr() string	{ return s.addr }
+
+// Returns a URL suitable for mysql.Open.
+func (s *Server) URL(dbname string) string {
+	return fmt.Sprintf("mysql://root@%s/%s", s.addr, dbname)
+}
+
+// Scripts the response to query, which must match the statement text
+// exactly.  Queries without a handler fail with an error.
+func (s *Server) Handle(query string, h Handler) {
+	s.lock.Lock();
+	s.handlers[query] = h;
+	s.lock.Unlock();
+}
+
+// Scripts a fixed response to query.
+func (s *Server) HandleResult(query string, r *Result) {
+	s.Handle(query, func(string, []interface{}) *Result { return r })
+}
+
+// The number of connections accepted so far.
+func (s *Server) Accepted() (n int) {
+	s.lock.Lock();
+	n = int(s.threadId);
+	s.lock.Unlock();
+	return;
+}
+
+// The number of statements prepared so far, over all connections.
+func (s *Server) Prepared() (n int) {
+	s.lock.Lock();
+	n = s.prepared;
+	s.lock.Unlock();
+	return;
+}
+
+// The number of statements closed so far, over all connections.
+func (s *Server) Closed() (n int) {
+	s.lock.Lock();
+	n = s.closed;
+	s.lock.Unlock();
+	return;
+}
+
+// The capability flags and character set the last client to connect asked
+// for.
+func (s *Server) Client() (flags uint32, charset byte) {
+	s.lock.Lock();
+	flags, charset = s.flags, s.charset;
+	s.lock.Unlock();
+	return;
+}
+
+// Offers TLS to the connections accepted from now on, with the certificate
+// and private key in the given PEM files.
+func (s *Server) StartTLS(certFile, keyFile string) os.Error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile);
+	if err != nil {
+		return err
+	}
+	s.lock.Lock();
+	s.tls = &tls.Config{Certificates: []tls.Certificate{cert}};
+	s.lock.Unlock();
+	return nil;
+}
+
+// Drops every open connection, as a restarting server would.
+func (s *Server) Disconnect() {
+	s.lock.Lock();
+	for _, c := range s.sessions {
+		if c != nil {
+			c.nc.Close()
+		}
+	}
+	s.lock.Unlock();
+}
+
+// Stops accepting connections.  Connections already open are left alone.
+func (s *Server) Close() os.Error	{ return s.listener.Close() }
+
+// Interrupts the statement running on connection id, if any.
+func (s *Server) killQuery(id uint32) bool {
+	s.lock.Lock();
+	c := s.sessions[id];
+	s.lock.Unlock();
+	if c != nil {
+		select {
+		case c.kill <- true:
+		default:
+		}
+	}
+	return c != nil;
+}
+
+func (s *Server) forget(id uint32) {
+	s.lock.Lock();
+	s.sessions[id] = nil;
+	s.lock.Unlock();
+}
+
+func (s *Server) handler(query string) (h Handler, ok bool) {
+	s.lock.Lock();
+	h, ok = s.handlers[query];
+	s.lock.Unlock();
+	return;
+}
+
+func (s *Server) serve() {
+	for {
+		nc, e := s.listener.Accept();
+		if e != nil {
+			return
+		}
+		s.lock.Lock();
+		s.threadId++;
+		c := &session{
+			server: s,
+			nc: nc,
+			rd: bufio.NewReader(nc),
+			id: s.threadId,
+			stmts: make(map[uint32]*stmt),
+			kill: make(chan bool, 1),
+		};
+		s.sessions[c.id] = c;
+		s.lock.Unlock();
+		go c.run();
+	}
+}
+
+type stmt struct {
+	query	string;
+	nparams	int;
+	types	[]uint16;
+
+	// The rows of the open cursor not yet fetched, if any.
+	cursor	[][]interface{};
+	result	*Result;
+
+	// Parameter values sent with COM_STMT_SEND_LONG_DATA.
+	long	map[uint16]*bytes.Buffer;
+}
+
+// A single client connection.
+type session struct {
+	server		*Server;
+	nc		net.Conn;
+	rd		*bufio.Reader;
+	seq		byte;
+	compressed	bool;
+	cseq		byte;
+	id		uint32;
+	stmts		map[uint32]*stmt;
+	nextStmt	uint32;
+	kill		chan bool;
+
+	// Set by SET autocommit=0.  A real server only sets IN_TRANS once a
+	// statement has run, but it's never long in coming.
+	noAutocommit	bool;
+
+	// Set by START TRANSACTION until COMMIT or ROLLBACK.
+	inTrans	bool;
+}
+
+func (c *session) run() {
+	defer c.nc.Close();
+	defer c.server.forget(c.id);
+
+	if c.handshake() != nil {
+		return
+	}
+	for {
+		c.seq = 0;
+		p, e := c.readPacket();
+
+		// A KILL QUERY only interrupts a running statement.
+		select {
+		case <-c.kill:
+		default:
+		}
+		if e != nil || !c.dispatch(p) {
+			return
+		}
+	}
+}
+
+// Waits ns nanoseconds, returning true if a KILL QUERY came first.
+func (c *session) sleep(ns int64) bool {
+	done := make(chan bool, 1);
+	go func() {
+		time.Sleep(ns);
+		done <- true;
+	}();
+	select {
+	case <-c.kill:
+		return true
+	case <-done:
+	}
+	return false;
+}
+
+func (c *session) readPacket() (p []byte, err os.Error) {
+	header := make([]byte, 4);
+	if _, err = io.ReadFull(c.rd, header); err != nil {
+		return
+	}
+	c.seq = header[3] + 1;
+	p = make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16);
+	_, err = io.ReadFull(c.rd, p);
+	return;
+}
+
+func (c *session) writePacket(p []byte) (err os.Error) {
+	var b bytes.Buffer;
+	n := len(p);
+	b.WriteByte(byte(n));
+	b.WriteByte(byte(n >> 8));
+	b.WriteByte(byte(n >> 16));
+	b.WriteByte(c.seq);
+	b.Write(p);
+	c.seq++;
+	return c.write(b.Bytes());
+}
+
+// Writes to the connection, in a compressed packet if the client asked for
+// compression.  Only payloads big enough are actually compressed, so that
+// the client sees both kinds.
+func (c *session) write(p []byte) (err os.Error) {
+	if !c.compressed {
+		_, err = c.nc.Write(p);
+		return;
+	}
+	body, size := p, 0;
+	if len(p) >= 50 {
+		var z bytes.Buffer;
+		w, _ := zlib.NewDeflater(&z);
+		w.Write(p);
+		w.Close();
+		body, size = z.Bytes(), len(p);
+	}
+	var b bytes.Buffer;
+	putUint24(&b, uint32(len(body)));
+	b.WriteByte(c.cseq);
+	putUint24(&b, uint32(size));
+	b.Write(body);
+	c.cseq++;
+	_, err = c.nc.Write(b.Bytes());
+	return;
+}
+
+// A connection whose reads go through the reader that may already hold
+// what the client sent after the SSL request.
+type bufferedConn struct {
+	net.Conn;
+	rd	*bufio.Reader;
+}
+
+func (c *bufferedConn) Read(p []byte) (int, os.Error)	{ return c.rd.Read(p) }
+
+// Inflates what the client sends once compression is on.
+type inflater struct {
+	c	*session;
+	rd	io.Reader;
+	buf	*bytes.Buffer;
+}
+
+func (r *inflater) Read(p []byte) (n int, err os.Error) {
+	if r.buf.Len() == 0 {
+		header := make([]byte, 7);
+		if _, err = io.ReadFull(r.rd, header); err != nil {
+			return
+		}
+		r.c.cseq = header[3] + 1;
+		body := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16);
+		if _, err = io.ReadFull(r.rd, body); err != nil {
+			return
+		}
+		size := int(header[4]) | int(header[5])<<8 | int(header[6])<<16;
+		if size == 0 {
+			r.buf.Write(body)
+		} else {
+			z, e := zlib.NewInflater(bytes.NewBuffer(body));
+			if e != nil {
+				return 0, e
+			}
+			data := make([]byte, size);
+			_, err = io.ReadFull(z, data);
+			z.Close();
+			if err != nil {
+				return
+			}
+			r.buf.Write(data);
+		}
+	}
+	return r.buf.Read(p);
+}
+
+func (c *session) handshake() (err os.Error) {
+	var b bytes.Buffer;
+	b.WriteByte(10);
+	putNullString(&b, serverVersion);
+	putUint32(&b, c.id);
+	b.WriteString("abcdefgh");	// scramble, first part
+	b.WriteByte(0);
+	c.server.lock.Lock();
+	config := c.server.tls;
+	c.server.lock.Unlock();
+	caps := uint32(capabilities);
+	if config != nil {
+		caps |= clientSSL
+	}
+	putUint16(&b, uint16(caps&0xffff));
+	b.WriteByte(utf8Charset);
+	putUint16(&b, statusAutocommit);
+	putUint16(&b, uint16(caps>>16));
+	b.WriteByte(21);	// scramble length
+	b.Write(make([]byte, 10));
+	putNullString(&b, "ijklmnopqrst");
+	if err = c.writePacket(b.Bytes()); err != nil {
+		return
+	}
+
+	// Any credentials are accepted.
+	p, err := c.readPacket();
+	if err != nil {
+		return
+	}
+	r := &reader{buf: p};
+	if config != nil && len(p) == 32 && r.readUint32()&clientSSL != 0 {
+		conn := tls.Server(&bufferedConn{c.nc, c.rd}, config);
+		if err = conn.Handshake(); err != nil {
+			return
+		}
+		c.nc, c.rd = conn, bufio.NewReader(conn);
+		if p, err = c.readPacket(); err != nil {
+			return
+		}
+		r = &reader{buf: p};
+	}
+	flags := r.readUint32();
+	r.readUint32();
+	c.server.lock.Lock();
+	c.server.flags, c.server.charset = flags, r.readByte();
+	c.server.lock.Unlock();
+
+	if err = c.writeOK(OK(0, 0)); err == nil && flags&clientCompress != 0 {
+		c.rd = bufio.NewReader(&inflater{c, c.rd, new(bytes.Buffer)});
+		c.compressed = true;
+	}
+	return;
+}
+
+func (c *session) dispatch(p []byte) bool {
+	if len(p) == 0 {
+		return false
+	}
+	arg := p[1:len(p)];
+	switch p[0] {
+	case comQuit:
+		return false
+	case comPing, comInitDb:
+		c.writeOK(OK(0, 0))
+	case comStmtReset:
+		if s := c.stmts[getUint32(arg)]; s != nil {
+			s.result, s.cursor, s.long = nil, nil, nil
+		}
+		c.writeOK(OK(0, 0));
+	case comQuery:
+		c.query(string(arg))
+	case comStmtPrepare:
+		c.prepare(string(arg))
+	case comStmtExecute:
+		c.execute(arg)
+	case comStmtSendLongData:
+		c.sendLongData(arg)
+	case comStmtFetch:
+		c.fetch(arg)
+	case comStmtClose:
+		c.stmts[getUint32(arg)] = nil;
+		c.server.lock.Lock();
+		c.server.closed++;
+		c.server.lock.Unlock();
+	default:
+		c.writeResult(Error(1047, "08S01", "Unknown command"), false)
+	}
+	return true;
+}
+
+func (c *session) lookup(query string) (h Handler, ok bool) {
+	if h, ok = c.server.handler(query); !ok {
+		c.writeResult(Error(1064, "42000",
+			fmt.Sprintf("mysqltest: no response scripted for %q", query)),
+			false)
+	}
+	return;
+}
+
+func (c *session) query(query string) {
+	if strings.HasPrefix(query, "KILL QUERY ") {
+		id, e := strconv.Atoui64(query[len("KILL QUERY "):len(query)]);
+		if e != nil || !c.server.killQuery(uint32(id)) {
+			c.writeResult(Error(1094, "HY000",
+				fmt.Sprintf("Unknown thread id: %s", query[len("KILL QUERY "):len(query)])),
+				false);
+			return;
+		}
+		c.writeOK(OK(0, 0));
+		return;
+	}
+	if h, ok := c.lookup(query); ok {
+		res := h(query, nil);
+		c.track(query, res);
+		c.writeResult(res, false);
+	}
+}
+
+// Follows the statements that start and end transactions, for status.
+func (c *session) track(query string, res *Result) {
+	if res != nil && res.Errno != 0 {
+		return
+	}
+	switch query {
+	case "SET autocommit=0":
+		c.noAutocommit = true
+	case "SET autocommit=1":
+		c.noAutocommit, c.inTrans = false, false
+	case "START TRANSACTION":
+		c.inTrans = true
+	case "COMMIT", "ROLLBACK":
+		c.inTrans = false
+	}
+}
+
+func (c *session) prepare(query string) {
+	if _, ok := c.lookup(query); !ok {
+		return
+	}
+
+	// Placeholders are counted naively, so scripted statements shouldn't
+	// contain a '?' inside a string literal.
+	s := &stmt{query: query};
+	for i := 0; i < len(query); i++ {
+		if query[i] == '?' {
+			s.nparams++
+		}
+	}
+	c.nextStmt++;
+	c.stmts[c.nextStmt] = s;
+	c.server.lock.Lock();
+	c.server.prepared++;
+	c.server.lock.Unlock();
+
+	var b bytes.Buffer;
+	b.WriteByte(0);
+	putUint32(&b, c.nextStmt);
+	putUint16(&b, 0);	// columns are only described on execute
+	putUint16(&b, uint16(s.nparams));
+	b.WriteByte(0);
+	putUint16(&b, 0);
+	c.writePacket(b.Bytes());
+
+	if s.nparams > 0 {
+		for i := 0; i < s.nparams; i++ {
+			c.writePacket(columnDefinition(Column{Name: "?", Type: 253}))
+		}
+		c.writeEOF(0, 0);
+	}
+}
+
+func (c *session) execute(arg []byte) {
+	r := &reader{buf: arg};
+	s := c.stmts[r.readUint32()];
+	if s == nil {
+		c.writeResult(Error(1243, "HY000",
+			"Unknown prepared statement handler"), false);
+		return;
+	}
+	flags := r.readByte();
+	r.readBytes(4);	// iteration count
+
+	var args []interface{};
+	if s.nparams > 0 {
+		args = make([]interface{}, s.nparams);
+		nulls := r.readBytes((s.nparams + 7) / 8);
+		if r.readByte() == 1 {
+			s.types = make([]uint16, s.nparams);
+			for i := range s.types {
+				s.types[i] = r.readUint16()
+			}
+		}
+		for i := range args {
+			if long, ok := s.long[uint16(i)]; ok {
+				args[i] = long.Bytes()
+			} else if nulls[i/8]&(1<<uint(i%8)) == 0 {
+				args[i] = r.param(s.types[i])
+			}
+		}
+	}
+	s.long = nil;
+
+	if h, ok := c.server.handler(s.query); ok {
+		res := h(s.query, args);
+		c.track(s.query, res);
+		if flags&1 != 0 && res != nil && res.Errno == 0 && res.Columns != nil &&
+			res.More == nil {
+			// CURSOR_TYPE_READ_ONLY: rows wait for COM_STMT_FETCH.
+			s.result, s.cursor = res, res.Rows;
+			c.writeColumns(res.Columns, statusCursorExists);
+		} else {
+			c.writeResult(res, true)
+		}
+	} else {
+		c.writeResult(Error(1064, "42000",
+			"mysqltest: handler removed"), true)
+	}
+}
+
+// Adds the flags every OK and EOF packet carries to status.
+func (c *session) status(status uint16) uint16 {
+	if c.inTrans || c.noAutocommit {
+		status |= statusInTrans
+	}
+	if !c.noAutocommit {
+		status |= statusAutocommit
+	}
+	return status;
+}
+
+func (c *session) writeOK(res *Result) os.Error {
+	var b bytes.Buffer;
+	b.WriteByte(0);
+	putLengthEncodedInt(&b, res.AffectedRows);
+	putLengthEncodedInt(&b, res.InsertId);
+	putUint16(&b, c.status(res.Status));
+	putUint16(&b, res.Warnings);
+	return c.writePacket(b.Bytes());
+}
+
+func (c *session) writeEOF(warnings, status uint16) os.Error {
+	var b bytes.Buffer;
+	b.WriteByte(0xfe);
+	putUint16(&b, warnings);
+	putUint16(&b, c.status(status));
+	return c.writePacket(b.Bytes());
+}
+
+func (c *session) writeResult(res *Result, binary bool) {
+	if res == nil {
+		res = OK(0, 0)
+	}
+	if res.Delay > 0 && c.sleep(res.Delay) {
+		res = Error(1317, "70100", "Query execution was interrupted")
+	}
+	if res.Errno != 0 {
+		var b bytes.Buffer;
+		b.WriteByte(0xff);
+		putUint16(&b, res.Errno);
+		b.WriteByte('#');
+		sqlstate := res.SQLState;
+		if len(sqlstate) != 5 {
+			sqlstate = "HY000"
+		}
+		b.WriteString(sqlstate);
+		b.WriteString(res.Message);
+		c.writePacket(b.Bytes());
+		return;
+	}
+	if len(res.LocalInfile) > 0 {
+		c.localInfile(res);
+		return;
+	}
+	status := res.Status;
+	if res.More != nil {
+		status |= statusMoreResults
+	}
+	if res.Columns == nil {
+		ok := *res;
+		ok.Status = status;
+		c.writeOK(&ok);
+	} else {
+		c.writeColumns(res.Columns, status);
+		for _, row := range res.Rows {
+			if binary {
+				c.writePacket(binaryRow(res.Columns, row))
+			} else {
+				c.writePacket(textRow(row))
+			}
+		}
+		// As with MySQL, only the EOF after the columns says these
+		// are OUT parameters.
+		c.writeEOF(res.Warnings, status&^statusPsOutParams);
+	}
+	if res.More != nil {
+		c.writeResult(res.More, binary)
+	}
+}
+
+// Asks for the file named by res.LocalInfile and reads it up to the empty
+// packet that ends it.
+func (c *session) localInfile(res *Result) {
+	var b bytes.Buffer;
+	b.WriteByte(0xfb);
+	b.WriteString(res.LocalInfile);
+	c.writePacket(b.Bytes());
+
+	n := uint64(0);
+	for {
+		p, e := c.readPacket();
+		if e != nil {
+			return
+		}
+		if len(p) == 0 {
+			break
+		}
+		n += uint64(len(p));
+	}
+	c.writeOK(OK(n, 0));
+}
+
+// Sends the column count, definitions and EOF that start a result set.
+func (c *session) writeColumns(columns []Column, status uint16) {
+	var b bytes.Buffer;
+	putLengthEncodedInt(&b, uint64(len(columns)));
+	c.writePacket(b.Bytes());
+	for _, col := range columns {
+		c.writePacket(columnDefinition(col))
+	}
+	c.writeEOF(0, status);
+}
+
+// Appends to a parameter's long data.  There is no reply.
+func (c *session) sendLongData(arg []byte) {
+	r := &reader{buf: arg};
+	s := c.stmts[r.readUint32()];
+	if s == nil {
+		return
+	}
+	if s.long == nil {
+		s.long = make(map[uint16]*bytes.Buffer)
+	}
+	i := r.readUint16();
+	if s.long[i] == nil {
+		s.long[i] = new(bytes.Buffer)
+	}
+	s.long[i].Write(arg[r.pos:len(arg)]);
+}
+
+// Sends the next rows of a cursor opened by execute.
+func (c *session) fetch(arg []byte) {
+	r := &reader{buf: arg};
+	id := r.readUint32();
+	n := int(r.readUint32());
+	s := c.stmts[id];
+	if s == nil || s.result == nil {
+		c.writeResult(Error(1421, "HY000",
+			fmt.Sprintf("The statement (%d) has no open cursor.", id)), false);
+		return;
+	}
+	if n > len(s.cursor) {
+		n = len(s.cursor)
+	}
+	for _, row := range s.cursor[0:n] {
+		c.writePacket(binaryRow(s.result.Columns, row))
+	}
+	s.cursor = s.cursor[n:len(s.cursor)];
+
+	status := uint16(statusCursorExists);
+	if len(s.cursor) == 0 {
+		status |= statusLastRowSent;
+		s.result = nil;
+	}
+	c.writeEOF(0, status);
+}
+
+func columnDefinition(col Column) []byte {
+	var b bytes.Buffer;
+	putLengthEncodedString(&b, strings.Bytes("def"));
+	putLengthEncodedString(&b, strings.Bytes("test"));
+	putLengthEncodedString(&b, strings.Bytes(col.Table));
+	putLengthEncodedString(&b, strings.Bytes(col.Table));
+	orgName := col.OrgName;
+	if orgName == "" {
+		orgName = col.Name
+	}
+	putLengthEncodedString(&b, strings.Bytes(col.Name));
+	putLengthEncodedString(&b, strings.Bytes(orgName));
+	b.WriteByte(0x0c);
+	charset := col.Charset;
+	if charset == 0 {
+		charset = utf8Charset
+	}
+	putUint16(&b, charset);
+	putUint32(&b, col.Length);
+	b.WriteByte(col.Type);
+	putUint16(&b, col.Flags);
+	b.WriteByte(col.Decimals);
+	putUint16(&b, 0);
+	return b.Bytes();
+}
+
+func textRow(row []interface{}) []byte {
+	var b bytes.Buffer;
+	for _, v := range row {
+		if v == nil {
+			b.WriteByte(0xfb)
+		} else {
+			putLengthEncodedString(&b, toBytes(v))
+		}
+	}
+	return b.Bytes();
+}
+
+func binaryRow(columns []Column, row []interface{}) []byte {
+	var b bytes.Buffer;
+	b.WriteByte(0);
+	nulls := make([]byte, (len(columns)+7+2)/8);
+	for i, v := range row {
+		if v == nil {
+			bit := uint(i + 2);
+			nulls[bit/8] |= 1 << (bit % 8);
+		}
+	}
+	b.Write(nulls);
+
+	for i, v := range row {
+		if v == nil {
+			continue
+		}
+		switch columns[i].Type {
+		case 1:	// TINY
+			b.WriteByte(byte(toInt64(v)))
+		case 2, 13:	// SHORT, YEAR
+			putUint16(&b, uint16(toInt64(v)))
+		case 3, 9:	// LONG, INT24
+			putUint32(&b, uint32(toInt64(v)))
+		case 8:	// LONGLONG
+			putUint64(&b, uint64(toInt64(v)))
+		case 4:	// FLOAT
+			putUint32(&b, math.Float32bits(float32(toFloat64(v))))
+		case 5:	// DOUBLE
+			putUint64(&b, math.Float64bits(toFloat64(v)))
+		case 7, 10, 11, 12:	// TIMESTAMP, DATE, TIME, DATETIME
+			raw := toBytes(v);
+			b.WriteByte(byte(len(raw)));
+			b.Write(raw);
+		default:
+			putLengthEncodedString(&b, toBytes(v))
+		}
+	}
+	return b.Bytes();
+}
+
+func toInt64(v interface{}) int64 {
+	switch x := v.(type) {
+	case int:
+		return int64(x)
+	case int8:
+		return int64(x)
+	case int16:
+		return int64(x)
+	case int32:
+		return int64(x)
+	case int64:
+		return x
+	case uint:
+		return int64(x)
+	case uint8:
+		return int64(x)
+	case uint16:
+		return int64(x)
+	case uint32:
+		return int64(x)
+	case uint64:
+		return int64(x)
+	case float64:
+		return int64(x)
+	case bool:
+		if x {
+			return 1
+		}
+	case string:
+		n, _ := strconv.Atoi64(x);
+		return n;
+	}
+	return 0;
+}
+
+func toFloat64(v interface{}) float64 {
+	switch x := v.(type) {
+	case float32:
+		return float64(x)
+	case float64:
+		return x
+	case string:
+		f, _ := strconv.Atof64(x);
+		return f;
+	}
+	return float64(toInt64(v));
+}
+
+func toBytes(v interface{}) []byte {
+	switch x := v.(type) {
+	case []byte:
+		return x
+	case string:
+		return strings.Bytes(x)
+	}
+	return strings.Bytes(fmt.Sprint(v));
+}
+
+type reader struct {
+	buf	[]byte;
+	pos	int;
+}
+
+func (r *reader) readBytes(n int) (b []byte) {
+	if r.pos+n > len(r.buf) {
+		n = len(r.buf) - r.pos
+	}
+	b = r.buf[r.pos : r.pos+n];
+	r.pos += n;
+	return;
+}
+
+func (r *reader) readByte() byte {
+	if b := r.readBytes(1); len(b) == 1 {
+		return b[0]
+	}
+	return 0;
+}
+
+func (r *reader) readUint16() uint16	{ return uint16(r.readUint(2)) }
+func (r *reader) readUint32() uint32	{ return uint32(r.readUint(4)) }
+
+func (r *reader) readUint(n int) (v uint64) {
+	for i, b := range r.readBytes(n) {
+		v |= uint64(b) << uint(8*i)
+	}
+	return;
+}
+
+func (r *reader) readLengthEncoded() []byte {
+	n := uint64(r.readByte());
+	switch n {
+	case 0xfc:
+		n = r.readUint(2)
+	case 0xfd:
+		n = r.readUint(3)
+	case 0xfe:
+		n = r.readUint(8)
+	}
+	return r.readBytes(int(n));
+}
+
+// Decodes a parameter sent with the given type, the low byte of which is a
+// mysql.MysqlType and the high byte 0x80 for unsigned values.
+func (r *reader) param(t uint16) interface{} {
+	unsigned := t&0x8000 != 0;
+	var n uint64;
+	switch t & 0xff {
+	case 1:
+		n = r.readUint(1);
+		if !unsigned {
+			return int64(int8(n))
+		}
+	case 2, 13:
+		n = r.readUint(2);
+		if !unsigned {
+			return int64(int16(n))
+		}
+	case 3, 9:
+		n = r.readUint(4);
+		if !unsigned {
+			return int64(int32(n))
+		}
+	case 8:
+		n = r.readUint(8);
+		if !unsigned {
+			return int64(n)
+		}
+	case 4:
+		return float64(math.Float32frombits(uint32(r.readUint(4))))
+	case 5:
+		return math.Float64frombits(r.readUint(8))
+	case 7, 10, 11, 12:
+		return r.readBytes(int(r.readByte()))
+	case 249, 250, 251, 252:
+		return r.readLengthEncoded()
+	default:
+		return string(r.readLengthEncoded())
+	}
+	return n;
+}
+
+func getUint32(b []byte) uint32	{ return (&reader{buf: b}).readUint32() }
+
+func putUint16(b *bytes.Buffer, v uint16) {
+	b.WriteByte(byte(v));
+	b.WriteByte(byte(v >> 8));
+}
+
+func putUint24(b *bytes.Buffer, v uint32) {
+	b.WriteByte(byte(v));
+	b.WriteByte(byte(v >> 8));
+	b.WriteByte(byte(v >> 16));
+}
+
+func putUint32(b *bytes.Buffer, v uint32) {
+	for i := uint(0); i < 32; i += 8 {
+		b.WriteByte(byte(v >> i))
+	}
+}
+
+func putUint64(b *bytes.Buffer, v uint64) {
+	for i := uint(0); i < 64; i += 8 {
+		b.WriteByte(byte(v >> i))
+	}
+}
+
+func putLengthEncodedInt(b *bytes.Buffer, n uint64) {
+	switch {
+	case n < 0xfb:
+		b.WriteByte(byte(n))
+	case n <= 0xffff:
+		b.WriteByte(0xfc);
+		putUint16(b, uint16(n));
+	case n <= 0xffffff:
+		b.WriteByte(0xfd);
+		b.WriteByte(byte(n));
+		b.WriteByte(byte(n >> 8));
+		b.WriteByte(byte(n >> 16));
+	default:
+		b.WriteByte(0xfe);
+		putUint64(b, n);
+	}
+}
+
+func putLengthEncodedString(b *bytes.Buffer, s []byte) {
+	putLengthEncodedInt(b, uint64(len(s)));
+	b.Write(s);
+}
+
+func putNullString(b *bytes.Buffer, s string) {
+	b.WriteString(s);
+	b.WriteByte(0);
+}
@@ -0,0 +1,106 @@
+// Copyright 2009 Eden Li. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Connection options, given as the query parameters of the URL or set in a
+// Config.
+package mysql
+
+import (
+	"strings";
+	"strconv";
+	"crypto/tls";
+)
+
+// What the options of a Config come down to, much as mysql_options would
+// set them up for libmysqlclient.
+type options struct {
+	// Timeouts in nanoseconds, 0 meaning none.
+	connectTimeout	int64;
+	readTimeout	int64;
+	writeTimeout	int64;
+
+	charset		byte;	// the collation sent in the handshake
+	compress	bool;
+	localInfile	bool;
+	multiStatements	bool;
+	foundRows	bool;
+
+	// Run in order on every new connection.
+	initCommands	[]string;
+
+	// Open a new session when the connection is found to be lost.
+	reconnect	bool;
+
+	// TLS, see tls.go.
+	sslMode		int;
+	sslCA		string;
+	sslCert		string;
+	sslKey		string;
+	sslCiphers	[]uint16;
+	sslServerName	string;
+	tls		*tls.Config;	// nil unless TLS is to be used
+}
+
+// Collation ids of the character sets, for MYSQL_SET_CHARSET_NAME.  Each
+// one gets its default collation.
+var charsets = map[string]byte{
+	"big5": 1,
+	"dec8": 3,
+	"cp850": 4,
+	"hp8": 6,
+	"koi8r": 7,
+	"latin1": 8,
+	"latin2": 9,
+	"swe7": 10,
+	"ascii": 11,
+	"ujis": 12,
+	"sjis": 13,
+	"hebrew": 16,
+	"tis620": 18,
+	"euckr": 19,
+	"koi8u": 22,
+	"gb2312": 24,
+	"greek": 25,
+	"cp1250": 26,
+	"gbk": 28,
+	"latin5": 30,
+	"armscii8": 32,
+	"utf8": 33,
+	"ucs2": 35,
+	"cp866": 36,
+	"keybcs2": 37,
+	"macce": 38,
+	"macroman": 39,
+	"cp852": 40,
+	"latin7": 41,
+	"utf8mb4": 45,
+	"cp1251": 51,
+	"utf16": 54,
+	"cp1256": 57,
+	"cp1257": 59,
+	"utf32": 60,
+	"binary": 63,
+	"geostd8": 92,
+	"cp932": 95,
+	"eucjpms": 97,
+}
+
+// Converts a number of seconds to nanoseconds.
+func parseSeconds(s string) (ns int64, ok bool) {
+	f, e := strconv.Atof64(s);
+	if e != nil || f < 0 {
+		return 0, false
+	}
+	return int64(f * 1e9), true;
+}
+
+func parseBool(s string) (b bool, ok bool) {
+	switch strings.ToLower(s) {
+	case "1", "true", "on", "yes":
+		return true, true
+	case "0", "false", "off", "no":
+		return false, true
+	}
+	return false, false;
+}
@@ -0,0 +1,331 @@
+// Copyright 2009 Eden Li. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Packet framing and the primitive encodings of the MySQL client/server
+// protocol.  All integers on the wire are little-endian.
+package mysql
+
+import (
+	"io";
+	"os";
+	"fmt";
+	"bytes";
+)
+
+// Reads a single logical packet, joining the continuation packets the server
+// uses for payloads of 16MB or more.
+func (h *mysqlConn) readPacket() (payload []byte, err os.Error) {
+	payload, _, err = h.readPacketMax(0);
+	return;
+}
+
+// Reads a packet as readPacket does, unless max is non-zero and the packet
+// is longer than max bytes.  Such a packet is read off the wire without
+// being kept, so the connection stays in sync, and only its length is
+// returned.
+func (h *mysqlConn) readPacketMax(max int) (payload []byte, dropped int, err os.Error) {
+	if h.nc == nil {
+		return nil, 0, h.setError(crServerGoneError, "HY000",
+			"MySQL server has gone away")
+	}
+
+	var joined bytes.Buffer;
+	header := make([]byte, 4);
+	size := 0;
+	for {
+		if _, e := io.ReadFull(h.rd, header); e != nil {
+			return nil, 0, h.lost(e)
+		}
+		if header[3] != h.seq {
+			return nil, 0, h.abort(crMalformedPacket,
+				fmt.Sprintf("Packets out of order (got %d, expected %d)",
+					header[3], h.seq))
+		}
+		h.seq++;
+
+		n := int(getUint24(header));
+		size += n;
+		if max > 0 && size > max {
+			if e := h.discard(n); e != nil {
+				return nil, 0, h.lost(e)
+			}
+		} else {
+			chunk := make([]byte, n);
+			if _, e := io.ReadFull(h.rd, chunk); e != nil {
+				return nil, 0, h.lost(e)
+			}
+			if n < maxPacketSize && joined.Len() == 0 {
+				payload = chunk
+			} else {
+				joined.Write(chunk)
+			}
+		}
+		if n < maxPacketSize {
+			break
+		}
+	}
+
+	if max > 0 && size > max {
+		return nil, size, nil
+	}
+	if payload == nil {
+		payload = joined.Bytes()
+	}
+	if len(payload) == 0 {
+		return nil, 0, h.abort(crMalformedPacket, "Malformed packet")
+	}
+	return;
+}
+
+// Reads n bytes off the wire and throws them away.
+func (h *mysqlConn) discard(n int) (err os.Error) {
+	buf := make([]byte, longDataChunkSize);
+	for n > 0 && err == nil {
+		if n < len(buf) {
+			buf = buf[0:n]
+		}
+		var m int;
+		m, err = io.ReadFull(h.rd, buf);
+		n -= m;
+	}
+	return;
+}
+
+// Writes payload as one logical packet, splitting it into 16MB chunks as
+// required by the protocol.
+func (h *mysqlConn) writePacket(payload []byte) (err os.Error) {
+	if h.nc == nil {
+		return h.setError(crServerGoneError, "HY000",
+			"MySQL server has gone away")
+	}
+
+	for {
+		n := len(payload);
+		if n > maxPacketSize {
+			n = maxPacketSize
+		}
+
+		var b bytes.Buffer;
+		putUint24(&b, uint32(n));
+		b.WriteByte(h.seq);
+		b.Write(payload[0:n]);
+		h.seq++;
+
+		if e := h.write(b.Bytes()); e != nil {
+			return h.lost(e)
+		}
+
+		payload = payload[n:len(payload)];
+		if n < maxPacketSize {
+			break
+		}
+	}
+	return;
+}
+
+// Starts a new command, resetting the packet sequence and the error and
+// row counts left over from the previous command.  Fails while the rows of
+// an unbuffered result, or further results of the last statement, are still
+// waiting to be read.  Statements closed in the meantime are closed on the
+// server first.
+func (h *mysqlConn) writeCommand(cmd byte, arg []byte) os.Error {
+	if h.busy() {
+		return h.setError(crCommandsOutOfSync, "HY000",
+			"Commands out of sync; you can't run this command now")
+	}
+	for h.closing.Len() > 0 {
+		var b bytes.Buffer;
+		putUint32(&b, h.closing.Pop().(uint32));
+		if err := h.startCommand(comStmtClose, b.Bytes()); err != nil {
+			return err
+		}
+	}
+	return h.startCommand(cmd, arg);
+}
+
+// Whether results are still waiting to be read, keeping commands from being
+// sent.
+func (h *mysqlConn) busy() bool {
+	return h.unbuffered != nil || h.status&ServerMoreResultsExists != 0
+}
+
+func (h *mysqlConn) startCommand(cmd byte, arg []byte) os.Error {
+	h.seq, h.cseq = 0, 0;
+	h.clearError();
+	h.affectedRows, h.insertId, h.warnings = 0, 0, 0;
+
+	var b bytes.Buffer;
+	b.WriteByte(cmd);
+	b.Write(arg);
+	return h.writePacket(b.Bytes());
+}
+
+func isOKPacket(payload []byte) bool	{ return payload[0] == 0x00 }
+func isErrorPacket(payload []byte) bool	{ return payload[0] == 0xff }
+
+// EOF packets share their first byte with 8-byte length-encoded integers, so
+// only short packets are EOF packets.
+func isEOFPacket(payload []byte) bool {
+	return payload[0] == 0xfe && len(payload) < 9
+}
+
+// Decodes the fields of a single packet payload.  Reading past the end of the
+// payload yields zero values and sets short, so callers only need to check
+// once after decoding everything.
+type packetReader struct {
+	buf	[]byte;
+	pos	int;
+	short	bool;
+}
+
+func newPacketReader(payload []byte) *packetReader {
+	return &packetReader{buf: payload}
+}
+
+func (r *packetReader) remaining() int	{ return len(r.buf) - r.pos }
+
+func (r *packetReader) readBytes(n int) (b []byte) {
+	if n < 0 || n > r.remaining() {
+		r.short = true;
+		r.pos = len(r.buf);
+		if n < 0 {
+			n = 0
+		}
+		return make([]byte, n);
+	}
+	b = r.buf[r.pos : r.pos+n];
+	r.pos += n;
+	return;
+}
+
+func (r *packetReader) skip(n int)	{ r.readBytes(n) }
+
+func (r *packetReader) rest() []byte	{ return r.readBytes(r.remaining()) }
+
+func (r *packetReader) peekByte() byte {
+	if r.remaining() == 0 {
+		return 0
+	}
+	return r.buf[r.pos];
+}
+
+func (r *packetReader) readByte() byte	{ return r.readBytes(1)[0] }
+
+func (r *packetReader) readUint16() uint16	{ return getUint16(r.readBytes(2)) }
+
+func (r *packetReader) readUint32() uint32	{ return getUint32(r.readBytes(4)) }
+
+func (r *packetReader) readUint64() uint64	{ return getUint64(r.readBytes(8)) }
+
+// Reads a NUL-terminated string.
+func (r *packetReader) readNullString() string {
+	for i := r.pos; i < len(r.buf); i++ {
+		if r.buf[i] == 0 {
+			s := string(r.buf[r.pos:i]);
+			r.pos = i + 1;
+			return s;
+		}
+	}
+	r.short = true;
+	return string(r.rest());
+}
+
+// Reads a length-encoded integer.  isNull is set for the 0xfb marker used for
+// NULL in text protocol rows.
+func (r *packetReader) readLengthEncodedInt() (n uint64, isNull bool) {
+	switch b := r.readByte(); {
+	case b < 0xfb:
+		n = uint64(b)
+	case b == 0xfb:
+		isNull = true
+	case b == 0xfc:
+		n = uint64(r.readUint16())
+	case b == 0xfd:
+		n = uint64(getUint24(r.readBytes(3)))
+	case b == 0xfe:
+		n = r.readUint64()
+	default:
+		r.short = true
+	}
+	return;
+}
+
+// Reads a length-encoded string, returning nil for NULL.
+func (r *packetReader) readLengthEncodedString() []byte {
+	n, isNull := r.readLengthEncodedInt();
+	if isNull {
+		return nil
+	}
+	if n > uint64(r.remaining()) {
+		r.short = true;
+		return r.rest();
+	}
+	return r.readBytes(int(n));
+}
+
+func getUint16(b []byte) uint16	{ return uint16(b[0]) | uint16(b[1])<<8 }
+
+func getUint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func getUint32(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 |
+		uint32(b[3])<<24
+}
+
+func getUint64(b []byte) uint64 {
+	return uint64(getUint32(b[0:4])) | uint64(getUint32(b[4:8]))<<32
+}
+
+func putUint16(b *bytes.Buffer, v uint16) {
+	b.WriteByte(byte(v));
+	b.WriteByte(byte(v >> 8));
+}
+
+func putUint24(b *bytes.Buffer, v uint32) {
+	b.WriteByte(byte(v));
+	b.WriteByte(byte(v >> 8));
+	b.WriteByte(byte(v >> 16));
+}
+
+func putUint32(b *bytes.Buffer, v uint32) {
+	for i := uint(0); i < 32; i += 8 {
+		b.WriteByte(byte(v >> i))
+	}
+}
+
+func putUint64(b *bytes.Buffer, v uint64) {
+	for i := uint(0); i < 64; i += 8 {
+		b.WriteByte(byte(v >> i))
+	}
+}
+
+func putLengthEncodedInt(b *bytes.Buffer, n uint64) {
+	switch {
+	case n < 0xfb:
+		b.WriteByte(byte(n))
+	case n <= 0xffff:
+		b.WriteByte(0xfc);
+		putUint16(b, uint16(n));
+	case n <= 0xffffff:
+		b.WriteByte(0xfd);
+		b.WriteByte(byte(n));
+		b.WriteByte(byte(n >> 8));
+		b.WriteByte(byte(n >> 16));
+	default:
+		b.WriteByte(0xfe);
+		putUint64(b, n);
+	}
+}
+
+func putLengthEncodedString(b *bytes.Buffer, s []byte) {
+	putLengthEncodedInt(b, uint64(len(s)));
+	b.Write(s);
+}
+
+func putNullString(b *bytes.Buffer, s string) {
+	b.WriteString(s);
+	b.WriteByte(0);
+}
@@ -0,0 +1,211 @@
+// Copyright 2009 Eden Li. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Connection pooling.
+package mysql
+
+import (
+	"db";
+	"os";
+	"sync";
+	"time";
+	"container/vector";
+)
+
+var ErrPoolClosed = MysqlError("Pool has been closed")
+
+// A set of connections to one server, for goroutines that would otherwise
+// serialize on a single Connection.
+type Pool struct {
+	uri		string;
+	maxIdle		int;
+	maxLifetime	int64;
+
+	lock	*sync.Mutex;
+	idle	*vector.Vector;	// of Connection, most recently used last
+	out	map[*mysqlConn]bool;	// handed out by Get and not yet Put
+	closed	bool;
+
+	// Holds one token for every connection that may still be handed out,
+	// or is nil if there's no limit.
+	slots	chan bool;
+}
+
+// Creates a pool of connections opened with the same URL as Open takes.
+// At most maxOpen connections are handed out at once (0 for no limit), at
+// most maxIdle are kept around for reuse, and none is reused once it is
+// older than maxLifetime nanoseconds (0 for no limit).
+func NewPool(uri string, maxOpen, maxIdle int, maxLifetime int64) *Pool {
+	p := &Pool{uri: uri, maxIdle: maxIdle, maxLifetime: maxLifetime};
+	p.lock = new(sync.Mutex);
+	p.idle = new(vector.Vector);
+	p.out = make(map[*mysqlConn]bool);
+	if maxOpen > 0 {
+		p.slots = make(chan bool, maxOpen);
+		for i := 0; i < maxOpen; i++ {
+			p.slots <- true
+		}
+	}
+	return p;
+}
+
+// Hands out an idle connection that still answers a ping, or opens a new
+// one.  Blocks while maxOpen connections are out.
+func (p *Pool) Get() (conn Connection, err os.Error) {
+	if p.slots != nil {
+		<-p.slots
+	}
+
+	for {
+		c, ok, closed := p.takeIdle();
+		if closed {
+			p.release();
+			return conn, ErrPoolClosed;
+		}
+		if !ok {
+			break
+		}
+		if !p.expired(c) && c.Ping() == nil {
+			p.checkOut(c);
+			return c, nil;
+		}
+		c.Close();
+	}
+
+	dbc, err := open(p.uri);
+	if err != nil {
+		p.release();
+		return;
+	}
+	conn = dbc.(Connection);
+	p.checkOut(conn);
+	return;
+}
+
+// Gives back a connection from Get.  It's kept for reuse unless the pool
+// already holds maxIdle idle connections, it has outlived maxLifetime or it
+// has lost the server.  Giving back a connection that isn't out, such as
+// one already given back, does nothing.
+func (p *Pool) Put(conn Connection) {
+	p.lock.Lock();
+	out := p.out[conn.handle];
+	p.out[conn.handle] = false, false;
+	p.lock.Unlock();
+	if !out {
+		return
+	}
+
+	// Another goroutine may still be reconnecting or closing it.
+	conn.Lock();
+	usable := !p.expired(conn) && conn.handle.nc != nil;
+	conn.Unlock();
+
+	p.lock.Lock();
+	keep := usable && !p.closed && p.idle.Len() < p.maxIdle;
+	if keep {
+		p.idle.Push(conn)
+	}
+	p.lock.Unlock();
+
+	if !keep {
+		conn.Close()
+	}
+	p.release();
+}
+
+// Starts a transaction on a connection of its own, which goes back to the
+// pool on Commit or Rollback.
+func (p *Pool) Begin() (tx *Tx, err os.Error) {
+	conn, err := p.Get();
+	if err != nil {
+		return
+	}
+	if tx, err = conn.Begin(); err != nil {
+		p.Put(conn)
+	} else {
+		tx.pool = p
+	}
+	return;
+}
+
+// Prepares and executes query on a connection of its own, which goes back
+// to the pool when the ResultSet is closed.
+func (p *Pool) Execute(query string, parameters ...) (rs db.ResultSet, err os.Error) {
+	conn, err := p.Get();
+	if err != nil {
+		return
+	}
+	stmt, err := conn.Prepare(query);
+	if err != nil {
+		p.Put(conn);
+		return;
+	}
+	dbrs, err := conn.Execute(stmt, parameters);
+	if err != nil {
+		stmt.Close();
+		p.Put(conn);
+		return;
+	}
+	res := dbrs.(ResultSet);
+	res.pooled = &pooledResult{pool: p, conn: conn, stmt: stmt.(Statement)};
+	rs = res;
+	return;
+}
+
+// Closes the idle connections.  Connections still out are closed as they
+// are given back.
+func (p *Pool) Close() os.Error {
+	p.lock.Lock();
+	idle := p.idle;
+	p.idle = new(vector.Vector);
+	p.closed = true;
+	p.lock.Unlock();
+
+	for i := 0; i < idle.Len(); i++ {
+		idle.At(i).(Connection).Close()
+	}
+	return nil;
+}
+
+func (p *Pool) checkOut(conn Connection) {
+	p.lock.Lock();
+	p.out[conn.handle] = true;
+	p.lock.Unlock();
+}
+
+func (p *Pool) takeIdle() (conn Connection, ok, closed bool) {
+	p.lock.Lock();
+	if closed = p.closed; !closed && p.idle.Len() > 0 {
+		conn, ok = p.idle.Pop().(Connection), true
+	}
+	p.lock.Unlock();
+	return;
+}
+
+func (p *Pool) expired(conn Connection) bool {
+	return p.maxLifetime > 0 &&
+		time.Nanoseconds()-conn.handle.created > p.maxLifetime
+}
+
+func (p *Pool) release() {
+	if p.slots != nil {
+		p.slots <- true
+	}
+}
+
+// What a ResultSet from Pool.Execute gives back when closed.
+type pooledResult struct {
+	pool	*Pool;
+	conn	Connection;
+	stmt	Statement;
+	done	bool;
+}
+
+func (r *pooledResult) release() {
+	if !r.done {
+		r.done = true;
+		r.stmt.Close();
+		r.pool.Put(r.conn);
+	}
+}
@@ -0,0 +1,1259 @@
+// Copyright 2009 Eden Li. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Native implementation of the MySQL client/server protocol.  mysqlConn and
+// mysqlStmt play the parts of libmysqlclient's MYSQL and MYSQL_STMT handles.
+package mysql
+
+import (
+	"io";
+	"os";
+	"fmt";
+	"net";
+	"bufio";
+	"time";
+	"bytes";
+	"strings";
+	"crypto/sha1";
+	"container/vector";
+)
+
+// Describes a result set column or a statement parameter, as sent by the
+// server in a column definition packet.
+type field struct {
+	catalog		string;
+	db		string;
+	table		string;
+	orgTable	string;
+	name		string;
+	orgName		string;
+	charset		uint16;
+	length		uint32;
+	fieldType	MysqlType;
+	flags		uint16;
+	decimals	uint8;
+}
+
+// The state of a single connection to the server.
+type mysqlConn struct {
+	nc	net.Conn;
+	rd	*bufio.Reader;
+	seq	byte;
+
+	// The sequence of the outer packets of the compressed protocol.
+	compressed	bool;
+	cseq		byte;
+
+	// What connect was given, to open side connections with.
+	network, addr		string;
+	user, passwd, dbname	string;
+	opts			*options;
+
+	serverVersion	string;
+	threadId	uint32;
+	cipher		string;	// empty unless encrypted
+	capabilities	uint32;
+	status		uint16;
+	created		int64;	// time.Nanoseconds() when connected
+	loc		*Location;	// see Connection.SetLocation
+	maxColumnSize	int;		// see Connection.SetMaxColumnSize
+
+	// A result whose rows are still on the wire.  No other command can
+	// be sent until they have all been read.
+	unbuffered	*mysqlResult;
+
+	// What revive needs to bring a new session to where this one was:
+	// the open statements and the SET statements run so far, each a
+	// *sessionStmt.
+	stmts	vector.Vector;
+	session	vector.Vector;
+
+	// The ids of statements closed while the connection was busy, for
+	// writeCommand to close on the server once it's free.
+	closing	vector.Vector;
+
+	// Set between autocommit(false) and autocommit(true).
+	inTx	bool;
+
+	// Set when the connection was lost inside a transaction, until the
+	// transaction is finished or rolled back.  See lostTx.
+	txLost	bool;
+
+	cache	*stmtCache;	// for Connection.Query and ExecQuery
+
+	// Filled in by the last OK packet.
+	affectedRows	uint64;
+	insertId	uint64;
+	warnings	uint16;
+
+	// The last error, as mysql_errno/mysql_sqlstate/mysql_error would
+	// report it.
+	errno		uint16;
+	sqlstate	string;
+	errmsg		string;
+}
+
+// Connects and authenticates to the server listening at addr, which is a
+// "host:port" pair for "tcp" and a path for "unix".
+func connect(network, addr, user, passwd, dbname string, opts *options) (h *mysqlConn, err os.Error) {
+	h = &mysqlConn{loc: UTC, cache: newStmtCache(defaultStatementCacheSize)};
+	h.network, h.addr = network, addr;
+	h.user, h.passwd, h.dbname = user, passwd, dbname;
+	h.opts = opts;
+	if err = h.open(); err != nil {
+		h = nil
+	}
+	return;
+}
+
+// Starts a new session on h, running the init commands.  h is left
+// disconnected if that fails.
+func (h *mysqlConn) open() (err os.Error) {
+	h.created = time.Nanoseconds();
+	h.compressed, h.cipher = false, "";
+	h.unbuffered, h.inTx = nil, false;
+	for h.closing.Len() > 0 {
+		// The old session took its statements with it.
+		h.closing.Pop()
+	}
+	h.clearError();
+
+	nc, e := dial(h.network, h.addr, h.opts.connectTimeout);
+	if e != nil {
+		if h.network == "unix" {
+			return h.setError(crConnectionError, "HY000",
+				fmt.Sprintf("Can't connect to local MySQL server through socket '%s' (%s)",
+					h.addr, e))
+		}
+		return h.setError(crConnHostError, "HY000",
+			fmt.Sprintf("Can't connect to MySQL server on '%s' (%s)",
+				h.addr, e));
+	}
+	h.nc = nc;
+	h.rd = bufio.NewReader(nc);
+
+	// The connect timeout covers the handshake too.
+	nc.SetReadTimeout(h.opts.connectTimeout);
+	if err = h.handshake(h.user, h.passwd, h.dbname); err == nil {
+		nc.SetReadTimeout(h.opts.readTimeout);
+		nc.SetWriteTimeout(h.opts.writeTimeout);
+		if h.capabilities&clientCompress != 0 {
+			h.startCompression()
+		}
+		for _, cmd := range h.opts.initCommands {
+			if err = h.query(cmd); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil && h.nc != nil {
+		h.nc.Close();
+		h.nc = nil;
+	}
+	return;
+}
+
+// With the reconnect option, opens a new session for a connection that was
+// lost, replays its SET statements and prepares its open statements again.
+// A connection lost inside a Tx stays lost until the Tx is finished: the
+// rest of the transaction would otherwise run outside of one.
+func (h *mysqlConn) revive() (err os.Error) {
+	if h.nc != nil || !h.opts.reconnect || h.inTx {
+		return
+	}
+	if err = h.open(); err != nil {
+		return
+	}
+	for i := 0; i < h.session.Len() && err == nil; i++ {
+		err = h.session.At(i).(*sessionStmt).replay(h)
+	}
+	for i := 0; i < h.stmts.Len() && err == nil; i++ {
+		err = h.stmts.At(i).(*mysqlStmt).prepare()
+	}
+	return;
+}
+
+// Checks that query may run after the connection was lost inside a
+// transaction.  Until the caller rolls it back, or finishes its Tx, every
+// statement fails with ErrTxLost, so that the rest of the transaction isn't
+// run statement by statement in a new session.  A ROLLBACK acknowledges the
+// loss and goes ahead; a COMMIT fails, as there is nothing left to commit,
+// but acknowledges it too.
+func (h *mysqlConn) lostTx(query string) (err os.Error) {
+	if !h.txLost {
+		return
+	}
+	switch strings.ToUpper(strings.TrimSpace(query)) {
+	case "ROLLBACK", "ROLLBACK WORK":
+		h.txLost = false
+	case "COMMIT", "COMMIT WORK":
+		h.txLost = false;
+		err = ErrTxLost;
+	default:
+		err = ErrTxLost
+	}
+	return;
+}
+
+// Whether the statement changes the session in a way revive must replay.
+// SET TRANSACTION without SESSION only applies to the next transaction.
+func isSessionStatement(query string) bool {
+	q := strings.ToUpper(strings.TrimSpace(query));
+	return strings.HasPrefix(q, "SET ") && !strings.HasPrefix(q, "SET TRANSACTION")
+}
+
+// A SET statement for revive to replay, with the values of its parameters.
+type sessionStmt struct {
+	query	string;
+	params	[]BoundData;
+}
+
+// Records a SET statement that ran with params, for revive to replay.  A
+// statement is dropped once later ones have set every variable it sets, so
+// that the session doesn't grow with every value assigned.  Parameters sent
+// as long data have been read already, so their statements can't be
+// replayed and are left out.
+func (h *mysqlConn) remember(query string, params []BoundData) {
+	saved := make([]BoundData, len(params));
+	for i := range params {
+		if params[i].long != nil {
+			return
+		}
+		saved[i] = params[i];
+		saved[i].buffer = copyBytes(params[i].buffer[0:params[i].blen]);
+	}
+	h.session.Push(&sessionStmt{query, saved});
+
+	seen := make(map[string]bool);
+	for i := h.session.Len() - 1; i >= 0; i-- {
+		keep := false;
+		for _, name := range sessionVars(h.session.At(i).(*sessionStmt).query) {
+			if !seen[name] {
+				seen[name], keep = true, true
+			}
+		}
+		if !keep {
+			h.session.Delete(i)
+		}
+	}
+}
+
+// Runs the statement again, preparing it for the moment if it has
+// parameters.
+func (ss *sessionStmt) replay(h *mysqlConn) (err os.Error) {
+	if len(ss.params) == 0 {
+		return h.query(ss.query)
+	}
+	s := &mysqlStmt{conn: h, query: ss.query};
+	if err = s.prepare(); err == nil {
+		_, err = s.execute(ss.params);
+		if e := s.close(); err == nil {
+			err = e
+		}
+	}
+	return;
+}
+
+// The variables a SET statement assigns, upper-cased and without SESSION or
+// @@: "@A" and "TIME_ZONE" for "SET @a = 1, @@session.time_zone = '+0:00'".
+// Assignments without '=', such as NAMES utf8, go by their first word.
+func sessionVars(query string) []string {
+	q := strings.ToUpper(strings.TrimSpace(query));
+	q = q[len("SET "):len(q)];
+
+	// Split the assignments at the commas outside of quotes and
+	// parentheses.
+	var names vector.StringVector;
+	depth, quote, start := 0, byte(0), 0;
+	for i := 0; i <= len(q); i++ {
+		if i == len(q) {
+			names.Push(assignedName(q[start:i]));
+			break;
+		}
+		switch c := q[i]; {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			names.Push(assignedName(q[start:i]));
+			start = i + 1;
+		}
+	}
+	return names.Data();
+}
+
+// The name of the variable one assignment of a SET statement sets.
+func assignedName(a string) string {
+	a = strings.TrimSpace(a);
+	for _, prefix := range []string{"SESSION ", "LOCAL ", "@@SESSION.", "@@LOCAL.", "@@"} {
+		if strings.HasPrefix(a, prefix) {
+			a = strings.TrimSpace(a[len(prefix):len(a)])
+		}
+	}
+	end := strings.Index(a, "=");
+	if end < 0 {
+		if end = strings.Index(a, " "); end < 0 {
+			end = len(a)
+		}
+	}
+	for end > 0 && (a[end-1] == ' ' || a[end-1] == ':') {
+		end--
+	}
+	return a[0:end];
+}
+
+// Dials addr, giving up after timeout nanoseconds unless it is 0.
+func dial(network, addr string, timeout int64) (nc net.Conn, err os.Error) {
+	if timeout <= 0 {
+		return net.Dial(network, "", addr)
+	}
+
+	type dialed struct {
+		nc	net.Conn;
+		err	os.Error;
+	}
+	done := make(chan dialed, 1);
+	go func() {
+		c, e := net.Dial(network, "", addr);
+		done <- dialed{c, e};
+	}();
+	expired := make(chan bool, 1);
+	go func() {
+		time.Sleep(timeout);
+		expired <- true;
+	}();
+
+	select {
+	case d := <-done:
+		return d.nc, d.err
+	case <-expired:
+	}
+	// Nobody wants the connection should it turn up later.
+	go func() {
+		if d := <-done; d.nc != nil {
+			d.nc.Close()
+		}
+	}();
+	return nil, MysqlError("Connection timed out");
+}
+
+func (h *mysqlConn) setError(errno uint16, sqlstate, msg string) os.Error {
+	h.errno = errno;
+	h.sqlstate = sqlstate;
+	h.errmsg = msg;
+	return &Error{errno, sqlstate, msg};
+}
+
+func (h *mysqlConn) clearError() {
+	h.errno = 0;
+	h.sqlstate = "00000";
+	h.errmsg = "";
+}
+
+// Drops the network connection after an unrecoverable error, so that later
+// commands fail with "MySQL server has gone away" as they do with
+// libmysqlclient.
+func (h *mysqlConn) abort(errno uint16, msg string) os.Error {
+	if h.nc != nil {
+		if h.inTx || h.status&ServerStatusInTrans != 0 {
+			h.txLost = true
+		}
+		h.nc.Close();
+		h.nc = nil;
+	}
+	// Neither a result nor a transaction can carry on without the
+	// connection.
+	h.status &^= ServerMoreResultsExists | ServerStatusInTrans;
+	return h.setError(errno, "HY000", msg);
+}
+
+func (h *mysqlConn) lost(e os.Error) os.Error {
+	return h.abort(crServerLost,
+		fmt.Sprintf("Lost connection to MySQL server during query (%s)", e))
+}
+
+// Records the error described by an ERR packet and returns it.
+func (h *mysqlConn) serverError(payload []byte) os.Error {
+	r := newPacketReader(payload);
+	r.skip(1);
+	errno := r.readUint16();
+	sqlstate := "HY000";
+	if r.peekByte() == '#' {
+		r.skip(1);
+		sqlstate = string(r.readBytes(5));
+	}
+	// An error ends the results of a statement.
+	h.status &^= ServerMoreResultsExists;
+	return h.setError(errno, sqlstate, string(r.rest()));
+}
+
+func (h *mysqlConn) handleOK(payload []byte) {
+	r := newPacketReader(payload);
+	r.skip(1);
+	h.affectedRows, _ = r.readLengthEncodedInt();
+	h.insertId, _ = r.readLengthEncodedInt();
+	h.status = r.readUint16();
+	h.warnings = r.readUint16();
+}
+
+func (h *mysqlConn) handleEOF(payload []byte) {
+	r := newPacketReader(payload);
+	r.skip(1);
+	h.warnings = r.readUint16();
+	h.status = r.readUint16();
+}
+
+// Reads the response to a command that returns either OK or ERR.
+func (h *mysqlConn) readOK() (err os.Error) {
+	payload, err := h.readPacket();
+	switch {
+	case err != nil:
+		return
+	case isErrorPacket(payload):
+		err = h.serverError(payload)
+	case isOKPacket(payload):
+		h.handleOK(payload)
+	default:
+		err = h.abort(crMalformedPacket, "Malformed packet")
+	}
+	return;
+}
+
+// Reads the initial handshake packet and authenticates with
+// mysql_native_password.
+func (h *mysqlConn) handshake(user, passwd, dbname string) (err os.Error) {
+	h.seq = 0;
+	payload, err := h.readPacket();
+	if err != nil {
+		return
+	}
+	if isErrorPacket(payload) {
+		return h.serverError(payload)
+	}
+
+	r := newPacketReader(payload);
+	if v := r.readByte(); v != protocolVersion {
+		return h.setError(crUnknownError, "HY000",
+			fmt.Sprintf("Unsupported protocol version %d", v))
+	}
+	h.serverVersion = r.readNullString();
+	h.threadId = r.readUint32();
+
+	var scramble bytes.Buffer;
+	scramble.Write(r.readBytes(8));
+	r.skip(1);
+	h.capabilities = uint32(r.readUint16());
+	if r.remaining() > 0 {
+		r.skip(1);	// server character set
+		h.status = r.readUint16();
+		h.capabilities |= uint32(r.readUint16()) << 16;
+		n := int(r.readByte()) - 8;
+		r.skip(10);
+		if h.capabilities&clientSecureConnection != 0 {
+			if n < 13 {
+				n = 13
+			}
+			// The second part of the scramble is NUL-terminated.
+			scramble.Write(r.readBytes(n)[0 : n-1]);
+		}
+	}
+	if r.short {
+		return h.setError(crMalformedPacket, "HY000", "Malformed packet")
+	}
+	if h.capabilities&clientProtocol41 == 0 {
+		return h.setError(crUnknownError, "HY000",
+			fmt.Sprintf("Server %s does not support the 4.1 protocol",
+				h.serverVersion))
+	}
+
+	flags := uint32(clientLongPassword | clientLongFlag | clientProtocol41 |
+		clientTransactions | clientSecureConnection | clientMultiResults |
+		clientPsMultiResults | clientPluginAuth);
+	if len(dbname) > 0 {
+		flags |= clientConnectWithDb
+	}
+	if h.opts.foundRows {
+		flags |= clientFoundRows
+	}
+	if h.opts.compress {
+		flags |= clientCompress
+	}
+	if h.opts.localInfile {
+		flags |= clientLocalFiles
+	}
+	if h.opts.multiStatements {
+		flags |= clientMultiStatements
+	}
+	if h.opts.tls != nil {
+		flags |= clientSSL
+	}
+	h.capabilities &= flags;
+
+	if h.capabilities&clientSSL != 0 {
+		if err = h.startTLS(); err != nil {
+			return
+		}
+	} else if h.opts.sslMode >= sslRequired {
+		return h.setError(crSSLConnectionError, "HY000",
+			"SSL connection error: SSL is required but the server doesn't support it")
+	}
+
+	var b bytes.Buffer;
+	putUint32(&b, h.capabilities);
+	putUint32(&b, maxPacketSize);
+	b.WriteByte(h.opts.charset);
+	b.Write(make([]byte, 23));
+	putNullString(&b, user);
+	auth := scramblePassword(scramble.Bytes(), passwd);
+	b.WriteByte(byte(len(auth)));
+	b.Write(auth);
+	if h.capabilities&clientConnectWithDb != 0 {
+		putNullString(&b, dbname)
+	}
+	if h.capabilities&clientPluginAuth != 0 {
+		putNullString(&b, nativePasswordPlugin)
+	}
+	if err = h.writePacket(b.Bytes()); err != nil {
+		return
+	}
+
+	if payload, err = h.readPacket(); err != nil {
+		return
+	}
+	// The server may ask us to switch authentication methods, which we can
+	// only honour for mysql_native_password with a fresh scramble.
+	if payload[0] == 0xfe {
+		r = newPacketReader(payload);
+		r.skip(1);
+		if plugin := r.readNullString(); plugin != nativePasswordPlugin {
+			return h.setError(crAuthPluginCannotLoad, "HY000",
+				fmt.Sprintf("Authentication plugin '%s' is not supported",
+					plugin))
+		}
+		data := r.rest();
+		if len(data) > 0 && data[len(data)-1] == 0 {
+			data = data[0 : len(data)-1]
+		}
+		if err = h.writePacket(scramblePassword(data, passwd)); err != nil {
+			return
+		}
+		if payload, err = h.readPacket(); err != nil {
+			return
+		}
+	}
+
+	switch {
+	case isErrorPacket(payload):
+		err = h.serverError(payload)
+	case isOKPacket(payload):
+		h.handleOK(payload)
+	default:
+		err = h.setError(crMalformedPacket, "HY000", "Malformed packet")
+	}
+	return;
+}
+
+// Computes SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password))).
+func scramblePassword(scramble []byte, passwd string) []byte {
+	if len(passwd) == 0 {
+		return nil
+	}
+
+	h := sha1.New();
+	h.Write(strings.Bytes(passwd));
+	stage1 := h.Sum();
+
+	h = sha1.New();
+	h.Write(stage1);
+	stage2 := h.Sum();
+
+	h = sha1.New();
+	h.Write(scramble);
+	h.Write(stage2);
+	token := h.Sum();
+
+	for i := range token {
+		token[i] ^= stage1[i]
+	}
+	return token;
+}
+
+func parseField(payload []byte) (f field, err os.Error) {
+	r := newPacketReader(payload);
+	f.catalog = string(r.readLengthEncodedString());
+	f.db = string(r.readLengthEncodedString());
+	f.table = string(r.readLengthEncodedString());
+	f.orgTable = string(r.readLengthEncodedString());
+	f.name = string(r.readLengthEncodedString());
+	f.orgName = string(r.readLengthEncodedString());
+	r.readLengthEncodedInt();	// length of the fixed-size fields
+	f.charset = r.readUint16();
+	f.length = r.readUint32();
+	f.fieldType = MysqlType(r.readByte());
+	f.flags = r.readUint16();
+	f.decimals = r.readByte();
+	if r.short {
+		err = MysqlError("Malformed column definition")
+	}
+	return;
+}
+
+// Reads n column definitions followed by an EOF packet.
+func (h *mysqlConn) readFields(n int) (fields []field, err os.Error) {
+	fields = make([]field, n);
+	for i := range fields {
+		payload, e := h.readPacket();
+		if e != nil {
+			return nil, e
+		}
+		if fields[i], e = parseField(payload); e != nil {
+			return nil, h.abort(crMalformedPacket, e.String())
+		}
+	}
+
+	payload, err := h.readPacket();
+	if err != nil {
+		return nil, err
+	}
+	if !isEOFPacket(payload) {
+		return nil, h.abort(crCommandsOutOfSync,
+			"Commands out of sync; expected EOF after column definitions")
+	}
+	h.handleEOF(payload);
+	return;
+}
+
+// Reads the response to a command that may produce a result set.  A nil
+// columns with a nil error means the server answered with an OK packet.
+func (h *mysqlConn) readResultSetHeader() (columns []field, err os.Error) {
+	payload, err := h.readPacket();
+	switch {
+	case err != nil:
+		return
+	case isErrorPacket(payload):
+		err = h.serverError(payload)
+	case isOKPacket(payload):
+		h.handleOK(payload)
+	case payload[0] == 0xfb:
+		if err = h.sendLocalFile(string(payload[1:len(payload)])); err == nil {
+			return h.readResultSetHeader()
+		}
+	default:
+		r := newPacketReader(payload);
+		n, _ := r.readLengthEncodedInt();
+		if r.short || n == 0 {
+			return nil, h.abort(crMalformedPacket, "Malformed packet")
+		}
+		columns, err = h.readFields(int(n));
+	}
+	return;
+}
+
+// Reads the next row packet of a result set, returning nil once the
+// terminating EOF packet has been read.  A row longer than max bytes, unless
+// max is 0, is thrown away and only its length returned, as readPacketMax
+// does.
+func (h *mysqlConn) readRow(max int) (row []byte, dropped int, err os.Error) {
+	payload, dropped, err := h.readPacketMax(max);
+	switch {
+	case err != nil || dropped > 0:
+		return
+	case isEOFPacket(payload):
+		h.handleEOF(payload)
+	case isErrorPacket(payload):
+		err = h.serverError(payload)
+	default:
+		row = payload
+	}
+	return;
+}
+
+// Runs statements through the text protocol, discarding any rows they
+// return.  Used for session statements such as SET, and for init commands,
+// which may hold several statements when multi_statements is on.
+func (h *mysqlConn) query(sql string) (err os.Error) {
+	if err = h.writeCommand(comQuery, strings.Bytes(sql)); err != nil {
+		return
+	}
+	for {
+		columns, e := h.readResultSetHeader();
+		if e != nil {
+			return e
+		}
+		for columns != nil {
+			row, _, e := h.readRow(0);
+			if e != nil {
+				return e
+			}
+			if row == nil {
+				break
+			}
+		}
+		if h.status&ServerMoreResultsExists == 0 {
+			break
+		}
+	}
+	return;
+}
+
+// Answers a LOAD DATA LOCAL INFILE request with the contents of the file.
+// Unless local_infile is on, or should the file not open, the server gets
+// an empty file and the request fails on our side.
+func (h *mysqlConn) sendLocalFile(name string) (err os.Error) {
+	var f *os.File;
+	e := os.Error(MysqlError("LOAD DATA LOCAL INFILE is disabled; set local_infile"));
+	if h.opts.localInfile {
+		f, e = os.Open(name, os.O_RDONLY, 0)
+	}
+	if f != nil {
+		buf := make([]byte, longDataChunkSize);
+		for {
+			n, re := f.Read(buf);
+			if n > 0 {
+				if err = h.writePacket(buf[0:n]); err != nil {
+					f.Close();
+					return;
+				}
+			}
+			if re != nil {
+				if re != os.EOF {
+					e = re
+				}
+				break;
+			}
+		}
+		f.Close();
+	}
+	if err = h.writePacket(nil); err != nil {
+		return
+	}
+	if e != nil {
+		// The server answers the empty file all the same.
+		if _, err = h.readPacket(); err != nil {
+			return
+		}
+		return h.setError(crUnknownError, "HY000",
+			fmt.Sprintf("Can't send local file '%s' (%s)", name, e));
+	}
+	return;
+}
+
+// The equivalents of mysql_autocommit, mysql_commit and mysql_rollback.
+func (h *mysqlConn) autocommit(on bool) (err os.Error) {
+	if on {
+		h.inTx, h.txLost = false, false;
+		return h.query("SET autocommit=1");
+	}
+	err = h.query("SET autocommit=0");
+	h.inTx = err == nil;
+	return;
+}
+
+func (h *mysqlConn) commit() os.Error	{ return h.query("COMMIT") }
+func (h *mysqlConn) rollback() os.Error	{ return h.query("ROLLBACK") }
+
+// The equivalent of mysql_ping.
+func (h *mysqlConn) ping() (err os.Error) {
+	if err = h.writeCommand(comPing, nil); err == nil {
+		err = h.readOK()
+	}
+	return;
+}
+
+// Interrupts the statement h is running with a KILL QUERY sent from a
+// connection of its own, leaving h itself connected.
+func (h *mysqlConn) kill() (err os.Error) {
+	opts := *h.opts;
+	opts.initCommands = nil;
+	side, err := connect(h.network, h.addr, h.user, h.passwd, "", &opts);
+	if err == nil {
+		err = side.query(fmt.Sprintf("KILL QUERY %d", h.threadId));
+		side.close();
+	}
+	return;
+}
+
+// Sends COM_QUIT and closes the network connection.
+func (h *mysqlConn) close() {
+	h.unbuffered = nil;
+	h.cache.lru.Init();
+	if h.nc != nil {
+		h.writeCommand(comQuit, nil);
+		h.nc.Close();
+		h.nc = nil;
+	}
+}
+
+// A server-side prepared statement.
+type mysqlStmt struct {
+	conn	*mysqlConn;
+	query	string;
+	id	uint32;
+	params	[]field;
+	columns	[]field;
+
+	// Rows fetched at a time from a server-side cursor, or 0 to have the
+	// server send the whole result.
+	prefetch	uint32;
+}
+
+func (h *mysqlConn) prepare(query string) (s *mysqlStmt, err os.Error) {
+	s = &mysqlStmt{conn: h, query: query};
+	if err = s.prepare(); err != nil {
+		return nil, err
+	}
+	h.stmts.Push(s);
+	return;
+}
+
+// Prepares query, first reopening a connection that was lost with revive.
+// Preparing twice does no harm, so this is retried should the connection
+// turn out to be lost.
+func (h *mysqlConn) prepareRevived(query string) (s *mysqlStmt, err os.Error) {
+	if err = h.revive(); err == nil {
+		s, err = h.prepare(query);
+		if IsLostConnection(err) && h.revive() == nil && h.nc != nil {
+			s, err = h.prepare(query)
+		}
+	}
+	return;
+}
+
+// Prepares the statement's query on the server, which gives it a new id.
+func (s *mysqlStmt) prepare() (err os.Error) {
+	h := s.conn;
+	if err = h.writeCommand(comStmtPrepare, strings.Bytes(s.query)); err != nil {
+		return
+	}
+	payload, err := h.readPacket();
+	if err != nil {
+		return
+	}
+	if isErrorPacket(payload) {
+		return h.serverError(payload)
+	}
+
+	r := newPacketReader(payload);
+	r.skip(1);
+	s.id = r.readUint32();
+	ncolumns := int(r.readUint16());
+	nparams := int(r.readUint16());
+	r.skip(1);
+	h.warnings = r.readUint16();
+	if r.short {
+		return h.abort(crMalformedPacket, "Malformed packet")
+	}
+
+	s.params, s.columns = nil, nil;
+	if nparams > 0 {
+		if s.params, err = h.readFields(nparams); err != nil {
+			return
+		}
+	}
+	if ncolumns > 0 {
+		s.columns, err = h.readFields(ncolumns)
+	}
+	return;
+}
+
+func (s *mysqlStmt) paramCount() int	{ return len(s.params) }
+
+// Sends COM_STMT_EXECUTE and reads the response header.  If the statement
+// produced a result set, its rows are left on the wire to be read through the
+// returned result.
+func (s *mysqlStmt) execute(params []BoundData) (res *mysqlResult, err os.Error) {
+	for i := range params {
+		if params[i].long != nil {
+			if err = s.sendLongData(i, params[i].long); err != nil {
+				return
+			}
+		}
+	}
+
+	var b bytes.Buffer;
+	putUint32(&b, s.id);
+	if s.prefetch > 0 {
+		b.WriteByte(cursorTypeReadOnly)
+	} else {
+		b.WriteByte(cursorTypeNoCursor)
+	}
+	putUint32(&b, 1);	// iteration count
+
+	if n := len(params); n > 0 {
+		nulls := make([]byte, (n+7)/8);
+		for i := range params {
+			if params[i].is_null[0] == 1 {
+				nulls[i/8] |= 1 << uint(i%8)
+			}
+		}
+		b.Write(nulls);
+		b.WriteByte(1);	// types follow
+		for i := range params {
+			t := uint16(params[i].myType);
+			if params[i].is_unsigned {
+				t |= 0x8000
+			}
+			putUint16(&b, t);
+		}
+		for i := range params {
+			// Long data has been sent already.
+			if params[i].is_null[0] != 1 && params[i].long == nil {
+				writeParamValue(&b, &params[i])
+			}
+		}
+	}
+
+	h := s.conn;
+	if err = h.writeCommand(comStmtExecute, b.Bytes()); err != nil {
+		return
+	}
+	columns, err := h.readResultSetHeader();
+	if err == nil && columns != nil {
+		res = &mysqlResult{conn: h, columns: columns, status: h.status};
+		if h.status&ServerStatusCursorExists != 0 {
+			// The rows stay on the server until fetched.
+			res.stmt = s
+		}
+	}
+	return;
+}
+
+// Sends the value of parameter i in chunks read from r
+// (mysql_stmt_send_long_data).  The server doesn't reply, so a failure to
+// read r resets the statement to throw away what was sent.
+func (s *mysqlStmt) sendLongData(i int, r io.Reader) (err os.Error) {
+	chunk := make([]byte, longDataChunkSize);
+	for sent := false; ; sent = true {
+		n, e := io.ReadFull(r, chunk);
+		if n > 0 || !sent {
+			var b bytes.Buffer;
+			putUint32(&b, s.id);
+			putUint16(&b, uint16(i));
+			b.Write(chunk[0:n]);
+			if err = s.conn.writeCommand(comStmtSendLongData, b.Bytes()); err != nil {
+				return
+			}
+		}
+		if e == os.EOF || e == io.ErrUnexpectedEOF {
+			break
+		}
+		if e != nil {
+			s.reset();
+			return MysqlError(fmt.Sprintf("Couldn't read parameter %d: %s", i, e));
+		}
+	}
+	return;
+}
+
+// Clears long data sent for the statement and closes its cursor
+// (mysql_stmt_reset).
+func (s *mysqlStmt) reset() (err os.Error) {
+	var b bytes.Buffer;
+	putUint32(&b, s.id);
+	if err = s.conn.writeCommand(comStmtReset, b.Bytes()); err == nil {
+		err = s.conn.readOK()
+	}
+	return;
+}
+
+// Deallocates the statement on the server.  The server sends no reply.
+// While the rows of a result are in the way, the statement is only closed
+// once they have been read.
+func (s *mysqlStmt) close() (err os.Error) {
+	h := s.conn;
+	if h.busy() && h.nc != nil {
+		h.closing.Push(s.id)
+	} else {
+		var b bytes.Buffer;
+		putUint32(&b, s.id);
+		err = h.writeCommand(comStmtClose, b.Bytes());
+	}
+
+	stmts := &h.stmts;
+	for i := 0; i < stmts.Len(); i++ {
+		if stmts.At(i) == s {
+			stmts.Delete(i);
+			break;
+		}
+	}
+	return;
+}
+
+// Encodes a parameter value in the binary protocol format.
+func writeParamValue(b *bytes.Buffer, d *BoundData) {
+	value := d.buffer[0:d.blen];
+	switch n := binaryLength(d.myType); {
+	case n > 0:
+		b.Write(value)
+	case n == 0:
+		b.WriteByte(byte(len(value)));
+		b.Write(value);
+	default:
+		putLengthEncodedString(b, value)
+	}
+}
+
+// Returns the number of bytes the binary protocol uses for a value of type
+// t, 0 for the temporal types (which are prefixed by a length byte) and -1
+// for everything sent as a length-encoded string.
+func binaryLength(t MysqlType) int {
+	switch t {
+	case MysqlTypeTiny:
+		return 1
+	case MysqlTypeShort, MysqlTypeYear:
+		return 2
+	case MysqlTypeLong, MysqlTypeInt24, MysqlTypeFloat:
+		return 4
+	case MysqlTypeLonglong, MysqlTypeDouble:
+		return 8
+	case MysqlTypeDate, MysqlTypeTime, MysqlTypeDatetime,
+		MysqlTypeTimestamp, MysqlTypeNewdate:
+		return 0
+	}
+	return -1;
+}
+
+// Decodes a binary protocol row into data, one BoundData per column.  The
+// buffers alias the row packet.  Values are never truncated: a value longer
+// than maxSize, if it is non-zero, is an error instead.
+func decodeBinaryRow(row []byte, columns []field, data []BoundData, maxSize int) (err os.Error) {
+	r := newPacketReader(row);
+	r.skip(1);	// packet header, always 0x00
+	nulls := r.readBytes((len(columns) + 7 + 2) / 8);
+
+	for i := range columns {
+		d := &data[i];
+		if bit := uint(i + 2); nulls[bit/8]&(1<<(bit%8)) != 0 {
+			d.is_null[0] = 1;
+			d.buffer, d.blen = nil, 0;
+			continue;
+		}
+
+		var value []byte;
+		switch n := binaryLength(columns[i].fieldType); {
+		case n > 0:
+			value = r.readBytes(n)
+		case n == 0:
+			value = r.readBytes(int(r.readByte()))
+		default:
+			value = r.readLengthEncodedString();
+			if maxSize > 0 && len(value) > maxSize {
+				return &Error{crDataTruncated, "HY000",
+					fmt.Sprintf("Column %s: value of %d bytes is over the limit of %d",
+						columns[i].name, len(value), maxSize)}
+			}
+		}
+		d.is_null[0] = 0;
+		d.buffer, d.blen = value, len(value);
+	}
+
+	if r.short {
+		err = MysqlError("Malformed row packet")
+	}
+	return;
+}
+
+// A result set being read from the server, the equivalent of the result
+// libmysqlclient keeps in a MYSQL_STMT.
+type mysqlResult struct {
+	conn	*mysqlConn;
+	columns	[]field;
+	rows	*vector.Vector;
+	pos	int;
+
+	unbuffered	bool;		// rows are read from the wire by next
+	stmt		*mysqlStmt;	// rows are fetched from its cursor by next
+	eof		bool;
+
+	// Whether another result of the statement follows, which is known
+	// once the rows have all been read.
+	more	bool;
+
+	// The status sent after the column definitions, the only one that
+	// carries ServerPsOutParams.
+	status	uint16;
+}
+
+// Reads every row of the result off the wire, leaving the connection free
+// for other commands (mysql_stmt_store_result).  As with libmysqlclient, the
+// affected rows of a stored SELECT is its number of rows.
+func (res *mysqlResult) store() (err os.Error) {
+	rows := new(vector.Vector);
+	max := res.rowLimit();
+	for {
+		row, dropped, e := res.conn.readRow(max);
+		if e != nil {
+			return e
+		}
+		if dropped > 0 {
+			// Fails when fetched, as a value over the limit does.
+			rows.Push(res.tooLong(dropped));
+			continue;
+		}
+		if row == nil {
+			break
+		}
+		rows.Push(row);
+	}
+	res.rows = rows;
+	res.more = res.conn.status&ServerMoreResultsExists != 0;
+	res.conn.affectedRows = uint64(rows.Len());
+	return;
+}
+
+// Leaves the rows on the wire for next to read one at a time
+// (mysql_stmt_execute without mysql_stmt_store_result).  The connection
+// can't be used for anything else until they have been read.
+func (res *mysqlResult) use() {
+	res.unbuffered = true;
+	res.conn.unbuffered = res;
+}
+
+// Returns the next row packet, or nil once the result is exhausted.
+func (res *mysqlResult) next() (row []byte, err os.Error) {
+	for res.stmt != nil && !res.eof &&
+		(res.rows == nil || res.pos >= res.rows.Len()) {
+		if err = res.fetch(); err != nil {
+			return
+		}
+	}
+	if !res.unbuffered {
+		if res.rows != nil && res.pos < res.rows.Len() {
+			switch v := res.rows.At(res.pos).(type) {
+			case []byte:
+				row = v
+			case os.Error:
+				err = v
+			}
+			res.pos++;
+		}
+		return;
+	}
+
+	if res.eof {
+		return
+	}
+	row, dropped, err := res.conn.readRow(res.rowLimit());
+	if dropped > 0 {
+		return nil, res.tooLong(dropped)
+	}
+	if err != nil || row == nil {
+		res.eof = true;
+		res.more = err == nil && res.conn.status&ServerMoreResultsExists != 0;
+		res.conn.unbuffered = nil;
+	}
+	return;
+}
+
+// The longest a row of the result can be without a value over the
+// connection's maxColumnSize, or 0 if there is no limit.  Longer rows are
+// thrown away as they are read rather than held in memory.
+func (res *mysqlResult) rowLimit() int {
+	max := int64(res.conn.maxColumnSize);
+	if max <= 0 {
+		return 0
+	}
+	n := int64(1 + (len(res.columns)+7+2)/8);
+	for i := range res.columns {
+		switch m := binaryLength(res.columns[i].fieldType); {
+		case m > 0:
+			n += int64(m)
+		case m == 0:
+			n += 13	// a length byte and at most 12 bytes
+		default:
+			n += 9 + max	// the longest length prefix and the value
+		}
+	}
+	if n > 1<<31-1 {
+		return 0
+	}
+	return int(n);
+}
+
+// The error for a row rowLimit kept out, which has a value over the limit
+// in one of its columns.
+func (res *mysqlResult) tooLong(size int) os.Error {
+	names := make([]string, len(res.columns));
+	for i := range res.columns {
+		names[i] = res.columns[i].name
+	}
+	return &Error{crDataTruncated, "HY000",
+		fmt.Sprintf("Columns %s: row of %d bytes holds a value over the limit of %d",
+			strings.Join(names, ", "), size, res.conn.maxColumnSize)};
+}
+
+// Reads the header of the next result of a statement that returned several,
+// as a CALL does (mysql_stmt_next_result).  The rows of the previous one must
+// have been read.  Returns nil for an OK packet, as execute does.
+func (h *mysqlConn) nextResult() (res *mysqlResult, err os.Error) {
+	h.affectedRows, h.insertId, h.warnings = 0, 0, 0;
+	columns, err := h.readResultSetHeader();
+	if err == nil && columns != nil {
+		res = &mysqlResult{conn: h, columns: columns, status: h.status}
+	}
+	return;
+}
+
+// Reads the next batch of rows from the statement's cursor
+// (mysql_stmt_fetch with STMT_ATTR_PREFETCH_ROWS).
+func (res *mysqlResult) fetch() (err os.Error) {
+	var b bytes.Buffer;
+	putUint32(&b, res.stmt.id);
+	putUint32(&b, res.stmt.prefetch);
+
+	h := res.conn;
+	if err = h.writeCommand(comStmtFetch, b.Bytes()); err != nil {
+		res.eof = true;
+		return;
+	}
+	rows := new(vector.Vector);
+	max := res.rowLimit();
+	for {
+		row, dropped, e := h.readRow(max);
+		if e != nil {
+			res.eof = true;
+			return e;
+		}
+		if dropped > 0 {
+			rows.Push(res.tooLong(dropped));
+			continue;
+		}
+		if row == nil {
+			break
+		}
+		rows.Push(row);
+	}
+	res.rows, res.pos = rows, 0;
+	if h.status&ServerStatusLastRowSent != 0 {
+		res.eof = true
+	}
+	return;
+}
+
+// Closes the server-side cursor of a result that wasn't read to the end
+// (mysql_stmt_reset).
+func (res *mysqlResult) reset() (err os.Error) {
+	if res.stmt != nil && !res.eof {
+		res.eof = true;
+		err = res.stmt.reset();
+	}
+	return;
+}
+
+// Reads and throws away any rows left on the wire, freeing the connection.
+func (res *mysqlResult) free() (err os.Error) {
+	for err == nil && res.unbuffered && !res.eof {
+		_, err = res.next()
+	}
+	return;
+}
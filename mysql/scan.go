@@ -0,0 +1,300 @@
+// Copyright 2009 Eden Li. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Conversion of row values into typed destinations.
+package mysql
+
+import (
+	"os";
+	"fmt";
+	"time";
+	"reflect";
+	"strconv";
+	"strings";
+)
+
+// Nullable destinations for Scan.  Valid is false for NULL.
+type NullInt64 struct {
+	Int64	int64;
+	Valid	bool;
+}
+
+type NullFloat64 struct {
+	Float64	float64;
+	Valid	bool;
+}
+
+type NullString struct {
+	String	string;
+	Valid	bool;
+}
+
+type NullBool struct {
+	Bool	bool;
+	Valid	bool;
+}
+
+type NullTime struct {
+	Time	time.Time;
+	Valid	bool;
+}
+
+// Copies the row's values into dest, which must be pointers, one per column.
+// Values are converted where nothing is lost: between integer widths,
+// between numbers and their text, and from anything to string or []byte.
+// NULL can only be stored in a pointer, which is set to nil, an
+// *interface{} or one of the Null types.
+func (r Result) Scan(dest ...) (err os.Error) {
+	d := reflect.NewValue(dest).(*reflect.StructValue);
+	if d.NumField() != len(r.data) {
+		return MysqlError(fmt.Sprintf("Scan: expected %d destinations, got %d",
+			len(r.data), d.NumField()))
+	}
+	for i := range r.data {
+		name := fmt.Sprintf("#%d", i);
+		if i < len(r.columns) {
+			name = r.columns[i].name
+		}
+		p, ok := d.Field(i).(*reflect.PtrValue);
+		if !ok || p.IsNil() {
+			return MysqlError(fmt.Sprintf("Scan: column %s: destination %T is not a non-nil pointer",
+				name, d.Field(i).Interface()))
+		}
+		if err = convertAssign(p, r.data[i]); err != nil {
+			return MysqlError(fmt.Sprintf("Scan: column %s: %s", name, err))
+		}
+	}
+	return;
+}
+
+// Stores src where p points.
+func convertAssign(p *reflect.PtrValue, src interface{}) os.Error {
+	return convertValue(p.Elem(), src)
+}
+
+// Stores src in the settable value v.
+func convertValue(v reflect.Value, src interface{}) (err os.Error) {
+	if i, ok := v.(*reflect.InterfaceValue); ok {
+		if src == nil {
+			i.Set(reflect.MakeZero(i.Type()))
+		} else {
+			i.Set(reflect.NewValue(src))
+		}
+		return;
+	}
+
+	switch v.Interface().(type) {
+	case NullInt64:
+		var n NullInt64;
+		n.Valid, err = convertNull(&n.Int64, src);
+		v.SetValue(reflect.NewValue(n));
+		return;
+	case NullFloat64:
+		var n NullFloat64;
+		n.Valid, err = convertNull(&n.Float64, src);
+		v.SetValue(reflect.NewValue(n));
+		return;
+	case NullString:
+		var n NullString;
+		n.Valid, err = convertNull(&n.String, src);
+		v.SetValue(reflect.NewValue(n));
+		return;
+	case NullBool:
+		var n NullBool;
+		n.Valid, err = convertNull(&n.Bool, src);
+		v.SetValue(reflect.NewValue(n));
+		return;
+	case NullTime:
+		var n NullTime;
+		n.Valid, err = convertNull(&n.Time, src);
+		v.SetValue(reflect.NewValue(n));
+		return;
+	case time.Time:
+		if t, ok := src.(*time.Time); ok {
+			v.SetValue(reflect.NewValue(*t));
+			return;
+		}
+	case Duration:
+		if d, ok := src.(Duration); ok {
+			v.SetValue(reflect.NewValue(d));
+			return;
+		}
+	}
+
+	if src == nil {
+		if q, ok := v.(*reflect.PtrValue); ok {
+			q.Set(reflect.MakeZero(q.Type()).(*reflect.PtrValue));
+			return;
+		}
+		return MysqlError(fmt.Sprintf("can't store NULL in %s", v.Type()));
+	}
+
+	s, isText := text(src);
+	switch d := v.(type) {
+	case *reflect.PtrValue:
+		// Allocate, then convert into the new value.
+		d.PointTo(reflect.MakeZero(d.Type().(*reflect.PtrType).Elem()));
+		return convertAssign(d, src);
+
+	case *reflect.StringValue:
+		if isText {
+			d.Set(s);
+			return;
+		}
+
+	case *reflect.SliceValue:
+		if _, ok := d.Interface().([]byte); ok && isText {
+			b := strings.Bytes(s);
+			if raw, ok := src.([]byte); ok {
+				b = copyBytes(raw)
+			}
+			d.Set(reflect.NewValue(b).(*reflect.SliceValue));
+			return;
+		}
+
+	case *reflect.BoolValue:
+		if n, e := strconv.Atoi64(s); isText && e == nil {
+			d.Set(n != 0);
+			return;
+		}
+
+	case *reflect.Float32Value, *reflect.Float64Value, *reflect.FloatValue:
+		if f, ok := number(src, s, isText); ok {
+			setFloat(d, f);
+			return;
+		}
+
+	default:
+		if !isText {
+			break
+		}
+		if n, e := strconv.Atoi64(s); e == nil && setInt(d, n) {
+			return
+		}
+		if n, e := strconv.Atoui64(s); e == nil && setUint(d, n) {
+			return
+		}
+	}
+	return MysqlError(fmt.Sprintf("can't convert %T %v to %s", src, src, v.Type()));
+}
+
+// Stores src, unless it's NULL, where p points.
+func convertNull(p interface{}, src interface{}) (valid bool, err os.Error) {
+	if src != nil {
+		valid, err = true, convertAssign(reflect.NewValue(p).(*reflect.PtrValue), src)
+	}
+	return;
+}
+
+// Returns the text form of src, if it has one that means the same thing.
+func text(src interface{}) (s string, ok bool) {
+	switch x := src.(type) {
+	case string:
+		return x, true
+	case []byte:
+		return string(x), true
+	case Decimal:
+		return string(x), true
+	case Duration:
+		return x.String(), true
+	case *time.Time:
+		return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", x.Year, x.Month,
+			x.Day, x.Hour, x.Minute, x.Second), true
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64,
+		float32, float64:
+		return fmt.Sprint(x), true
+	}
+	return;
+}
+
+func number(src interface{}, s string, isText bool) (f float64, ok bool) {
+	switch x := src.(type) {
+	case float32:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	if isText {
+		var e os.Error;
+		f, e = strconv.Atof64(s);
+		ok = e == nil;
+	}
+	return;
+}
+
+func setFloat(v reflect.Value, f float64) {
+	switch d := v.(type) {
+	case *reflect.FloatValue:
+		d.Set(float(f))
+	case *reflect.Float32Value:
+		d.Set(float32(f))
+	case *reflect.Float64Value:
+		d.Set(f)
+	}
+}
+
+// Stores n in a signed integer, returning false if it doesn't fit.
+func setInt(v reflect.Value, n int64) bool {
+	switch d := v.(type) {
+	case *reflect.IntValue:
+		if int64(int(n)) == n {
+			d.Set(int(n));
+			return true;
+		}
+	case *reflect.Int8Value:
+		if int64(int8(n)) == n {
+			d.Set(int8(n));
+			return true;
+		}
+	case *reflect.Int16Value:
+		if int64(int16(n)) == n {
+			d.Set(int16(n));
+			return true;
+		}
+	case *reflect.Int32Value:
+		if int64(int32(n)) == n {
+			d.Set(int32(n));
+			return true;
+		}
+	case *reflect.Int64Value:
+		d.Set(n);
+		return true;
+	}
+	return false;
+}
+
+// Stores n in an unsigned integer, returning false if it doesn't fit.
+func setUint(v reflect.Value, n uint64) bool {
+	switch d := v.(type) {
+	case *reflect.UintValue:
+		if uint64(uint(n)) == n {
+			d.Set(uint(n));
+			return true;
+		}
+	case *reflect.Uint8Value:
+		if uint64(uint8(n)) == n {
+			d.Set(uint8(n));
+			return true;
+		}
+	case *reflect.Uint16Value:
+		if uint64(uint16(n)) == n {
+			d.Set(uint16(n));
+			return true;
+		}
+	case *reflect.Uint32Value:
+		if uint64(uint32(n)) == n {
+			d.Set(uint32(n));
+			return true;
+		}
+	case *reflect.Uint64Value:
+		d.Set(n);
+		return true;
+	case *reflect.UintptrValue:
+		if uint64(uintptr(n)) == n {
+			d.Set(uintptr(n));
+			return true;
+		}
+	}
+	return false;
+}
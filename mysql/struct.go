@@ -0,0 +1,174 @@
+// Copyright 2009 Eden Li. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Mapping of result rows onto structs.
+package mysql
+
+import (
+	"os";
+	"fmt";
+	"sync";
+	"reflect";
+	"strings";
+	"container/vector";
+)
+
+// Where the columns of a row go in a struct type: the index path of the
+// field for each lower-cased column name.
+type structMap struct {
+	fields	map[string][]int;
+}
+
+var (
+	structMapLock	= new(sync.Mutex);
+	structMaps	= make(map[reflect.Type]*structMap);
+)
+
+// Returns the mapping for t, working it out the first time t is seen.
+func mapStruct(t *reflect.StructType) (m *structMap) {
+	structMapLock.Lock();
+	m, ok := structMaps[t];
+	if !ok {
+		m = &structMap{make(map[string][]int)};
+		m.add(t, nil);
+		structMaps[t] = m;
+	}
+	structMapLock.Unlock();
+	return;
+}
+
+// Adds the fields of t, found at index, to the mapping.  Fields of an
+// embedded struct are added as if they were the outer struct's own, but
+// lose to any outer field of the same name.
+func (m *structMap) add(t *reflect.StructType, index []int) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i);
+		path := make([]int, len(index)+1);
+		for j := range index {
+			path[j] = index[j]
+		}
+		path[len(index)] = i;
+
+		name := fieldColumn(f);
+		if name == "-" {
+			continue
+		}
+		if st, ok := f.Type.(*reflect.StructType); ok && f.Anonymous && name == "" {
+			m.add(st, path);
+			continue;
+		}
+		if len(f.PkgPath) > 0 {
+			// Unexported.
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		name = strings.ToLower(name);
+		if old, dup := m.fields[name]; !dup || len(old) > len(path) {
+			m.fields[name] = path
+		}
+	}
+}
+
+// Returns the column named by a `mysql:"column"` tag, or "".
+func fieldColumn(f reflect.StructField) string {
+	tag := f.Tag;
+	i := strings.Index(tag, `mysql:"`);
+	if i < 0 {
+		return ""
+	}
+	tag = tag[i+len(`mysql:"`) : len(tag)];
+	if j := strings.Index(tag, `"`); j >= 0 {
+		return tag[0:j]
+	}
+	return "";
+}
+
+// Copies the row into the struct dest points to.  A column goes to the field
+// tagged `mysql:"column"`, or else to the field of the same name, ignoring
+// case.  Fields of embedded structs count as the outer struct's own.  Fields
+// tagged `mysql:"-"` and columns without a field are left alone.  Values are
+// converted as by Scan, so NULL needs a pointer or Null type field.
+func (r Result) ScanStruct(dest interface{}) os.Error {
+	if p, ok := reflect.NewValue(dest).(*reflect.PtrValue); ok && !p.IsNil() {
+		if s, ok := p.Elem().(*reflect.StructValue); ok {
+			return r.scanStruct(s)
+		}
+	}
+	return MysqlError(fmt.Sprintf("ScanStruct: %T is not a pointer to a struct", dest));
+}
+
+func (r Result) scanStruct(s *reflect.StructValue) (err os.Error) {
+	m := mapStruct(s.Type().(*reflect.StructType));
+	for i, c := range r.columns {
+		path, ok := m.fields[strings.ToLower(c.name)];
+		if !ok {
+			continue
+		}
+		var v reflect.Value = s;
+		for _, j := range path {
+			v = v.(*reflect.StructValue).Field(j)
+		}
+		if err = convertValue(v, r.data[i]); err != nil {
+			return MysqlError(fmt.Sprintf("ScanStruct: column %s: %s", c.name, err))
+		}
+	}
+	return;
+}
+
+// Runs query and stores its rows, as ScanStruct does, in the slice dest
+// points to.  The slice is replaced, and may hold structs or pointers to
+// structs.
+func (conn Connection) QueryAll(dest interface{}, query string, params ...) (err os.Error) {
+	var slice *reflect.SliceValue;
+	p, ok := reflect.NewValue(dest).(*reflect.PtrValue);
+	if ok && !p.IsNil() {
+		slice, ok = p.Elem().(*reflect.SliceValue)
+	}
+	var elem reflect.Type;
+	if ok {
+		elem = slice.Type().(*reflect.SliceType).Elem()
+	}
+	pt, isPtr := elem.(*reflect.PtrType);
+	if isPtr {
+		elem = pt.Elem()
+	}
+	if _, isStruct := elem.(*reflect.StructType); !ok || !isStruct {
+		return MysqlError(fmt.Sprintf("QueryAll: %T is not a pointer to a slice of structs", dest))
+	}
+
+	rs, err := conn.Query(query, params);
+	if err != nil {
+		return
+	}
+	rows := new(vector.Vector);
+	for res := range rs.Iter() {
+		if err == nil {
+			err = res.Error()
+		}
+		rows.Push(res);
+	}
+	rs.Close();
+	if err != nil {
+		return
+	}
+
+	out := reflect.MakeSlice(slice.Type().(*reflect.SliceType), rows.Len(), rows.Len());
+	for i := 0; i < rows.Len(); i++ {
+		res := rows.At(i).(Result);
+		if isPtr {
+			s := reflect.MakeZero(elem).(*reflect.StructValue);
+			err = res.scanStruct(s);
+			out.Elem(i).(*reflect.PtrValue).PointTo(s);
+		} else {
+			err = res.scanStruct(out.Elem(i).(*reflect.StructValue))
+		}
+		if err != nil {
+			return
+		}
+	}
+	slice.Set(out);
+	return;
+}
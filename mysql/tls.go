@@ -0,0 +1,154 @@
+// Copyright 2009 Eden Li. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Encrypted connections.  The client asks for TLS with an SSL request packet,
+// a handshake response cut short after the character set, and carries on
+// with the handshake over TLS once it is set up.
+package mysql
+
+import (
+	"io";
+	"os";
+	"fmt";
+	"bufio";
+	"bytes";
+	"strings";
+	"crypto/tls";
+)
+
+// Values of the ssl_mode option, as for the --ssl-mode of the mysql client.
+const (
+	sslUnset	= iota;
+	sslDisabled;
+	sslPreferred;		// TLS if the server has it
+	sslRequired;		// TLS or nothing
+	sslVerifyCA;		// and the certificate is signed by ssl_ca
+	sslVerifyIdentity;	// and names the server
+)
+
+var sslModes = map[string]int{
+	"disabled": sslDisabled,
+	"preferred": sslPreferred,
+	"required": sslRequired,
+	"verify_ca": sslVerifyCA,
+	"verify_identity": sslVerifyIdentity,
+}
+
+// Cipher suites by their OpenSSL names, which is what ssl_cipher takes and
+// Connection.Cipher reports.
+var ciphers = map[string]uint16{
+	"RC4-SHA": 0x0005,
+	"DES-CBC3-SHA": 0x000a,
+	"AES128-SHA": 0x002f,
+	"AES256-SHA": 0x0035,
+	"AES128-GCM-SHA256": 0x009c,
+	"AES256-GCM-SHA384": 0x009d,
+	"ECDHE-ECDSA-AES128-SHA": 0xc009,
+	"ECDHE-ECDSA-AES256-SHA": 0xc00a,
+	"ECDHE-RSA-AES128-SHA": 0xc013,
+	"ECDHE-RSA-AES256-SHA": 0xc014,
+	"ECDHE-ECDSA-AES128-GCM-SHA256": 0xc02b,
+	"ECDHE-ECDSA-AES256-GCM-SHA384": 0xc02c,
+	"ECDHE-RSA-AES128-GCM-SHA256": 0xc02f,
+	"ECDHE-RSA-AES256-GCM-SHA384": 0xc030,
+	"ECDHE-RSA-CHACHA20-POLY1305": 0xcca8,
+	"ECDHE-ECDSA-CHACHA20-POLY1305": 0xcca9,
+}
+
+func cipherName(id uint16) string {
+	for name, v := range ciphers {
+		if v == id {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", id);
+}
+
+// Parses the colon-separated list of ssl_cipher.
+func parseCiphers(s string) (ids []uint16, ok bool) {
+	names := strings.Split(s, ":", 0);
+	ids = make([]uint16, len(names));
+	for i, name := range names {
+		if ids[i], ok = ciphers[strings.ToUpper(name)]; !ok {
+			return nil, false
+		}
+	}
+	return ids, len(ids) > 0;
+}
+
+// Settles the ssl_mode and loads the certificates the ssl_* options name.
+// Without an ssl_mode, ssl_ca implies verify_ca and the other ssl_* options
+// preferred.
+func (o *options) setupTLS() os.Error {
+	if (len(o.sslCert) > 0) != (len(o.sslKey) > 0) {
+		return MysqlError("ssl_cert and ssl_key go together")
+	}
+	if o.sslMode == sslUnset {
+		switch {
+		case len(o.sslCA) > 0:
+			o.sslMode = sslVerifyCA
+		case len(o.sslCert) > 0 || o.sslCiphers != nil || len(o.sslServerName) > 0:
+			o.sslMode = sslPreferred
+		default:
+			o.sslMode = sslDisabled
+		}
+	}
+	if o.sslMode == sslDisabled {
+		return nil
+	}
+
+	config := new(tls.Config);
+	if len(o.sslCA) > 0 {
+		pem, e := io.ReadFile(o.sslCA);
+		config.RootCAs = tls.NewCASet();
+		if e != nil || !config.RootCAs.SetFromPEM(pem) {
+			return MysqlError(fmt.Sprintf("Couldn't load CA certificates from %s", o.sslCA))
+		}
+	} else if o.sslMode >= sslVerifyCA {
+		return MysqlError("ssl_mode verify_ca and verify_identity need ssl_ca")
+	}
+	if len(o.sslCert) > 0 {
+		cert, e := tls.LoadX509KeyPair(o.sslCert, o.sslKey);
+		if e != nil {
+			return MysqlError(fmt.Sprintf("Couldn't load client certificate: %s", e))
+		}
+		config.Certificates = []tls.Certificate{cert};
+	}
+	config.CipherSuites = o.sslCiphers;
+	o.tls = config;
+	return nil;
+}
+
+// Sends the SSL request packet and sets up TLS over the connection.  The
+// handshake goes on over the encrypted connection.
+func (h *mysqlConn) startTLS() (err os.Error) {
+	var b bytes.Buffer;
+	putUint32(&b, h.capabilities);
+	putUint32(&b, maxPacketSize);
+	b.WriteByte(h.opts.charset);
+	b.Write(make([]byte, 23));
+	if err = h.writePacket(b.Bytes()); err != nil {
+		return
+	}
+
+	c := tls.Client(h.nc, h.opts.tls);
+	if e := c.Handshake(); e != nil {
+		return h.abort(crSSLConnectionError, fmt.Sprintf("SSL connection error: %s", e))
+	}
+	if h.opts.sslMode == sslVerifyIdentity {
+		name := h.opts.sslServerName;
+		if len(name) == 0 {
+			name = h.addr;
+			if i := strings.LastIndex(name, ":"); i >= 0 && h.network != "unix" {
+				name = name[0:i]
+			}
+		}
+		if e := c.VerifyHostname(name); e != nil {
+			return h.abort(crSSLConnectionError, fmt.Sprintf("SSL connection error: %s", e))
+		}
+	}
+	h.nc, h.rd = c, bufio.NewReader(c);
+	h.cipher = cipherName(c.ConnectionState().CipherSuite);
+	return;
+}
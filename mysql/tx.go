@@ -0,0 +1,112 @@
+// Copyright 2009 Eden Li. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Transactions.
+package mysql
+
+import (
+	"db";
+	"os";
+)
+
+var (
+	ErrTxDone	= MysqlError("Transaction has already been committed or rolled back");
+
+	// Returned by Tx.Execute and Tx.Exec for a statement prepared on
+	// another Connection, which would run outside of the transaction.
+	ErrTxConn	= MysqlError("Statement was prepared on another connection than the transaction's");
+
+	// Returned for statements run after the connection was lost inside a
+	// transaction, until the transaction is rolled back.
+	ErrTxLost	= MysqlError("Connection was lost inside a transaction; roll it back to carry on");
+)
+
+// A transaction started with Connection.Begin.  The transaction has the
+// connection to itself until it is committed or rolled back: calls made
+// through the Connection, from any goroutine, block until then.
+type Tx struct {
+	conn	Connection;
+	done	bool;
+	pool	*Pool;	// gets the connection back when done, if set
+}
+
+// Turns off autocommit and returns the transaction that now owns the
+// connection.  Waits for any other open transaction to finish first.
+func (conn Connection) Begin() (tx *Tx, err os.Error) {
+	conn.owner.Lock();
+	conn.Lock();
+	if conn.handle.txLost {
+		err = ErrTxLost
+	} else if err = conn.handle.revive(); err == nil {
+		err = conn.handle.autocommit(false)
+	}
+	conn.Unlock();
+
+	if err != nil {
+		conn.owner.Unlock()
+	} else {
+		tx = &Tx{conn: conn}
+	}
+	return;
+}
+
+func (tx *Tx) Prepare(query string) (dbs db.Statement, err os.Error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	return tx.conn.prepare(query);
+}
+
+func (tx *Tx) Execute(stmt db.Statement, parameters ...) (rs db.ResultSet, err os.Error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	s := stmt.(Statement);
+	if s.conn.handle != tx.conn.handle {
+		return nil, ErrTxConn
+	}
+	rs, err = NewResultSet(tx.conn, s, parameters);
+	return;
+}
+
+func (tx *Tx) Exec(stmt db.Statement, parameters ...) (affectedRows, insertId uint64, err os.Error) {
+	if tx.done {
+		return 0, 0, ErrTxDone
+	}
+	if s, ok := stmt.(Statement); ok && s.conn.handle != tx.conn.handle {
+		return 0, 0, ErrTxConn
+	}
+	return tx.conn.exec(stmt, nil, parameters);
+}
+
+func (tx *Tx) Commit() os.Error	{ return tx.finish(true) }
+
+func (tx *Tx) Rollback() os.Error	{ return tx.finish(false) }
+
+// Commits or rolls back, restores autocommit and hands the connection back.
+// The transaction is over even if this fails.
+func (tx *Tx) finish(commit bool) (err os.Error) {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	conn := tx.conn;
+	conn.Lock();
+	if commit {
+		err = conn.handle.commit()
+	} else {
+		err = conn.handle.rollback()
+	}
+	if e := conn.handle.autocommit(true); err == nil {
+		err = e
+	}
+	tx.done = true;
+	conn.Unlock();
+	conn.owner.Unlock();
+
+	if tx.pool != nil {
+		tx.pool.Put(conn)
+	}
+	return;
+}